@@ -1,4 +1,5 @@
 -- Example query.
+-- help: Number of example widgets for each label.
 WITH example_data as (
     SELECT "a" as label, 5 as widgets
     UNION ALL
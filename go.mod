@@ -3,6 +3,7 @@ module github.com/m-lab/prometheus-bigquery-exporter
 go 1.14
 
 require (
+	cloud.google.com/go v0.50.0
 	cloud.google.com/go/bigquery v1.3.0
 	github.com/alecthomas/units v0.0.0-20190924025748-f65c72e2690d // indirect
 	github.com/golang/protobuf v1.4.1 // indirect
@@ -15,9 +16,9 @@ require (
 	github.com/prometheus/promu v0.5.0 // indirect
 	github.com/spf13/afero v1.2.2
 	golang.org/x/net v0.0.0-20200513185701-a91f0712d120
-	golang.org/x/oauth2 v0.0.0-20200107190931-bf48bf16ab8d // indirect
+	golang.org/x/oauth2 v0.0.0-20200107190931-bf48bf16ab8d
 	golang.org/x/sys v0.0.0-20200513112337-417ce2331b5c // indirect
 	google.golang.org/api v0.15.0
 	google.golang.org/appengine v1.6.6 // indirect
-	gopkg.in/yaml.v2 v2.3.0 // indirect
+	gopkg.in/yaml.v2 v2.3.0
 )
@@ -0,0 +1,98 @@
+// Package clients manages the BigQuery clients used to run queries, so that
+// queries may be billed to different projects and run with different
+// credentials.
+package clients
+
+import (
+	"context"
+	"sync"
+
+	"cloud.google.com/go/bigquery"
+	"google.golang.org/api/option"
+)
+
+// Key identifies the configuration of a client. Queries with the same Key
+// share a client.
+type Key struct {
+	// Project is the GCP project billed for queries run with the client.
+	Project string
+	// CredentialsFile is the name of a service account JSON key file. If
+	// empty, application default credentials are used.
+	CredentialsFile string
+	// ImpersonateServiceAccount is the email of a service account to
+	// impersonate, using the credentials above. If empty, the credentials
+	// are used directly.
+	ImpersonateServiceAccount string
+}
+
+// options returns the client options for the credentials of the key.
+func (key Key) options(ctx context.Context) ([]option.ClientOption, error) {
+	var opts []option.ClientOption
+	if key.CredentialsFile != "" {
+		opts = append(opts, option.WithCredentialsFile(key.CredentialsFile))
+	}
+	if key.ImpersonateServiceAccount == "" {
+		return opts, nil
+	}
+	ts, err := impersonate(ctx, key.ImpersonateServiceAccount, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return []option.ClientOption{option.WithTokenSource(ts)}, nil
+}
+
+// newClient creates a new client for the key.
+var newClient = func(ctx context.Context, key Key) (*bigquery.Client, error) {
+	opts, err := key.options(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return bigquery.NewClient(ctx, key.Project, opts...)
+}
+
+// Pool creates clients on first use and caches them by Key.
+type Pool struct {
+	// ctx is used by clients for the lifetime of the pool, e.g. to refresh
+	// credentials.
+	ctx     context.Context
+	mux     sync.Mutex
+	clients map[Key]*bigquery.Client
+}
+
+// NewPool creates a new, empty Pool. Clients use ctx for their lifetime, so
+// ctx should not be done before the pool is closed.
+func NewPool(ctx context.Context) *Pool {
+	return &Pool{
+		ctx:     ctx,
+		clients: map[Key]*bigquery.Client{},
+	}
+}
+
+// Get returns the client for key, creating it if necessary.
+func (p *Pool) Get(key Key) (*bigquery.Client, error) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	if c, ok := p.clients[key]; ok {
+		return c, nil
+	}
+	c, err := newClient(p.ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	p.clients[key] = c
+	return c, nil
+}
+
+// Close closes all clients in the pool, and returns the last error.
+func (p *Pool) Close() error {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	var err error
+	for key, c := range p.clients {
+		if cerr := c.Close(); cerr != nil {
+			err = cerr
+		}
+		delete(p.clients, key)
+	}
+	return err
+}
@@ -0,0 +1,107 @@
+package clients
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"cloud.google.com/go/bigquery"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/option"
+)
+
+func TestPool_Get(t *testing.T) {
+	orig := newClient
+	defer func() { newClient = orig }()
+	created := 0
+	newClient = func(ctx context.Context, key Key) (*bigquery.Client, error) {
+		if key.Project == "error" {
+			return nil, fmt.Errorf("fake client error")
+		}
+		created++
+		return &bigquery.Client{}, nil
+	}
+	p := NewPool(context.Background())
+	a, err := p.Get(Key{Project: "a"})
+	if err != nil {
+		t.Fatalf("Pool.Get() error = %v", err)
+	}
+	a2, _ := p.Get(Key{Project: "a"})
+	b, _ := p.Get(Key{Project: "b"})
+	if a != a2 || a == b || created != 2 {
+		t.Errorf("Pool.Get() created %d clients, want 2 shared by project", created)
+	}
+	if _, err := p.Get(Key{Project: "error"}); err == nil {
+		t.Errorf("Pool.Get() expected error")
+	}
+}
+
+func TestPool_Close(t *testing.T) {
+	orig := newClient
+	defer func() { newClient = orig }()
+	newClient = func(ctx context.Context, key Key) (*bigquery.Client, error) {
+		// Create a real client that does not need credentials.
+		return bigquery.NewClient(ctx, key.Project, option.WithoutAuthentication())
+	}
+	p := NewPool(context.Background())
+	if _, err := p.Get(Key{Project: "mlab-testing"}); err != nil {
+		t.Fatalf("Pool.Get() error = %v", err)
+	}
+	if err := p.Close(); err != nil {
+		t.Errorf("Pool.Close() error = %v", err)
+	}
+	if len(p.clients) != 0 {
+		t.Errorf("Pool.Close() left %d clients", len(p.clients))
+	}
+}
+
+func TestKey_options(t *testing.T) {
+	orig := impersonate
+	defer func() { impersonate = orig }()
+	impersonate = func(ctx context.Context, target string, opts ...option.ClientOption) (oauth2.TokenSource, error) {
+		if len(opts) == 0 {
+			// Do not look for application default credentials.
+			opts = []option.ClientOption{option.WithoutAuthentication()}
+		}
+		return orig(ctx, target, opts...)
+	}
+	tests := []struct {
+		name    string
+		key     Key
+		want    int
+		wantErr bool
+	}{
+		{
+			name: "default-credentials",
+			key:  Key{Project: "a"},
+			want: 0,
+		},
+		{
+			name: "credentials-file",
+			key:  Key{Project: "a", CredentialsFile: "/fake/key.json"},
+			want: 1,
+		},
+		{
+			name: "impersonate",
+			key:  Key{Project: "a", ImpersonateServiceAccount: "bqx@a.iam.gserviceaccount.com"},
+			want: 1,
+		},
+		{
+			name:    "error-impersonate-missing-credentials-file",
+			key:     Key{Project: "a", CredentialsFile: "/fake/key.json", ImpersonateServiceAccount: "bqx@a.iam.gserviceaccount.com"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.key.options(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Key.options() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !tt.wantErr && len(got) != tt.want {
+				t.Errorf("Key.options() = %d options, want %d", len(got), tt.want)
+			}
+		})
+	}
+}
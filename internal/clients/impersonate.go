@@ -0,0 +1,49 @@
+package clients
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/iamcredentials/v1"
+	"google.golang.org/api/option"
+)
+
+// impersonator generates access tokens for a service account using the IAM
+// credentials API. The caller's credentials must be granted the
+// roles/iam.serviceAccountTokenCreator role on the service account.
+type impersonator struct {
+	ctx     context.Context
+	service *iamcredentials.Service
+	target  string
+}
+
+// Token generates a new access token for the impersonated service account.
+func (i *impersonator) Token() (*oauth2.Token, error) {
+	name := "projects/-/serviceAccounts/" + i.target
+	req := &iamcredentials.GenerateAccessTokenRequest{
+		Scope: []string{bigquery.Scope},
+	}
+	resp, err := i.service.Projects.ServiceAccounts.GenerateAccessToken(name, req).Context(i.ctx).Do()
+	if err != nil {
+		return nil, fmt.Errorf("impersonating %q: %v", i.target, err)
+	}
+	expiry, err := time.Parse(time.RFC3339, resp.ExpireTime)
+	if err != nil {
+		return nil, fmt.Errorf("impersonating %q: invalid expire time: %v", i.target, err)
+	}
+	return &oauth2.Token{AccessToken: resp.AccessToken, Expiry: expiry}, nil
+}
+
+// impersonate returns a token source for the target service account, using
+// the credentials given by opts to call the IAM credentials API. Tokens are
+// cached until they expire.
+var impersonate = func(ctx context.Context, target string, opts ...option.ClientOption) (oauth2.TokenSource, error) {
+	service, err := iamcredentials.NewService(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return oauth2.ReuseTokenSource(nil, &impersonator{ctx: ctx, service: service, target: target}), nil
+}
@@ -0,0 +1,67 @@
+package clients
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"google.golang.org/api/option"
+)
+
+func TestImpersonate(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		body    string
+		want    string
+		wantErr bool
+	}{
+		{
+			name:   "success",
+			status: http.StatusOK,
+			body:   `{"accessToken": "fake-token", "expireTime": "2030-01-01T00:00:00Z"}`,
+			want:   "fake-token",
+		},
+		{
+			name:    "error-permission-denied",
+			status:  http.StatusForbidden,
+			body:    `{"error": {"code": 403, "message": "denied"}}`,
+			wantErr: true,
+		},
+		{
+			name:    "error-bad-expire-time",
+			status:  http.StatusOK,
+			body:    `{"accessToken": "fake-token", "expireTime": "tomorrow"}`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if !strings.HasSuffix(r.URL.Path, "/serviceAccounts/bqx@fake.iam.gserviceaccount.com:generateAccessToken") {
+					t.Errorf("impersonate() requested %q", r.URL.Path)
+				}
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(tt.status)
+				fmt.Fprint(w, tt.body)
+			}))
+			defer srv.Close()
+			ts, err := impersonate(context.Background(), "bqx@fake.iam.gserviceaccount.com",
+				option.WithEndpoint(srv.URL+"/"), option.WithoutAuthentication())
+			if err != nil {
+				t.Fatalf("impersonate() error = %v", err)
+			}
+			tok, err := ts.Token()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Token() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !tt.wantErr && tok.AccessToken != tt.want {
+				t.Errorf("Token() = %q, want %q", tok.AccessToken, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,408 @@
+// Package config reads the query configuration file used by the
+// bigquery_exporter. The configuration file may be YAML or JSON, and lists the
+// queries to run along with the properties of the metrics they produce.
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// labelName matches valid prometheus label names, and metricSuffix matches
+// valid suffixes of prometheus metric names.
+var (
+	labelName    = regexp.MustCompile("^[a-zA-Z_][a-zA-Z0-9_]*$")
+	metricSuffix = regexp.MustCompile("^[a-zA-Z0-9_:]*$")
+)
+
+// Supported query types.
+const (
+	Gauge     = "gauge"
+	Counter   = "counter"
+	Histogram = "histogram"
+	Summary   = "summary"
+)
+
+// Supported counter policies. See sql.CounterPolicy for details.
+const (
+	CounterTotal = "total"
+	CounterDelta = "delta"
+	CounterMax   = "max"
+)
+
+// Supported duplicate policies. See sql.DuplicatePolicy for details.
+const (
+	DuplicateError = "error"
+	DuplicateFirst = "first"
+	DuplicateLast  = "last"
+	DuplicateSum   = "sum"
+	DuplicateMax   = "max"
+)
+
+// Supported query job priorities.
+const (
+	Interactive = "INTERACTIVE"
+	Batch       = "BATCH"
+)
+
+// Supported NULL policies.
+const (
+	// NullEmpty converts NULL labels to empty strings.
+	NullEmpty = "empty"
+	// NullSkip skips rows with NULL values.
+	NullSkip = "skip"
+	// NullNaN converts NULL values to NaN.
+	NullNaN = "nan"
+	// NullDefault converts NULL values to a default value.
+	NullDefault = "default"
+)
+
+// jobLabelKey and jobLabelValue match valid BigQuery job label keys and
+// values, and jobIDPrefix matches valid job ID prefixes.
+var (
+	jobLabelKey   = regexp.MustCompile("^[a-z][a-z0-9_-]{0,62}$")
+	jobLabelValue = regexp.MustCompile("^[a-z0-9_-]{0,63}$")
+	jobIDPrefix   = regexp.MustCompile("^[a-zA-Z0-9_-]{1,900}$")
+)
+
+// Query describes a single query and the metrics created from its results.
+type Query struct {
+	// Name is the metric name prefix. If empty, the base name of File is used.
+	Name string `yaml:"name"`
+	// Type is the metric type. If empty, Gauge is used.
+	Type string `yaml:"type"`
+	// CounterPolicy defines how counter query values are converted to counter
+	// values. If empty, CounterTotal is used. Only valid for Counter queries.
+	CounterPolicy string `yaml:"counter_policy"`
+	// Duplicates defines how results with the same label values are
+	// resolved. If empty, DuplicateError is used. DuplicateSum and
+	// DuplicateMax are only valid for Gauge and Counter queries.
+	Duplicates string `yaml:"duplicates"`
+	// Quantiles are the quantiles reported by Summary queries. If empty, the
+	// median, 90th and 99th percentiles are used.
+	Quantiles []float64 `yaml:"quantiles"`
+	// Help is the help text for metrics created from this query.
+	Help string `yaml:"help"`
+	// Unit is the unit of metric values, e.g. "seconds", added to help text.
+	Unit string `yaml:"unit"`
+	// Values holds settings for individual value columns, by column name.
+	Values map[string]Value `yaml:"values"`
+	// Columns declares the label and value columns of results. If nil,
+	// columns named "value*" are values and all other columns are labels.
+	// Only valid for Gauge and Counter queries.
+	Columns *Columns `yaml:"columns"`
+	// File is the name of a file containing the query. Relative names are
+	// resolved from the directory of the configuration file.
+	File string `yaml:"file"`
+	// SQL is an inline query. Exactly one of File or SQL must be given.
+	SQL string `yaml:"sql"`
+	// Refresh is the interval between query runs. If zero, the global refresh
+	// interval is used.
+	Refresh time.Duration `yaml:"refresh"`
+	// Timeout is the maximum time to run the query. If zero, the global
+	// timeout is used.
+	Timeout time.Duration `yaml:"timeout"`
+	// MaxBytesBilled limits the bytes billed for every run of the query, and
+	// the bytes processed estimated by a dry run when the query is loaded. If
+	// zero, the global limit is used.
+	MaxBytesBilled int64 `yaml:"max_bytes_billed"`
+	// Location is the processing location of query jobs, e.g. "US". If
+	// empty, BigQuery selects the location from the tables used.
+	Location string `yaml:"location"`
+	// Priority is the query job priority, Interactive or Batch. If empty,
+	// Interactive is used.
+	Priority string `yaml:"priority"`
+	// DisableQueryCache prevents results being served from the query cache.
+	DisableQueryCache bool `yaml:"disable_query_cache"`
+	// JobLabels are added to every query job, in addition to the labels
+	// exporter=bqx and query=<name>.
+	JobLabels map[string]string `yaml:"job_labels"`
+	// JobIDPrefix is the prefix of query job IDs. If empty, BigQuery
+	// generates the job IDs.
+	JobIDPrefix string `yaml:"job_id_prefix"`
+	// NullLabels is the policy for rows with NULL label columns, NullEmpty
+	// or NullSkip. If empty, NullEmpty is used.
+	NullLabels string `yaml:"null_labels"`
+	// NullValues is the policy for rows with NULL value columns, NullNaN,
+	// NullSkip or NullDefault. If empty, NullNaN is used.
+	NullValues string `yaml:"null_values"`
+	// NullDefault replaces NULL values when NullValues is NullDefault.
+	NullDefault float64 `yaml:"null_default"`
+	// Labels are static labels added to every metric created from this query.
+	Labels map[string]string `yaml:"labels"`
+	// Project is the GCP project used to run the query. If empty, the global
+	// project is used.
+	Project string `yaml:"project"`
+	// Credentials is the name of a service account JSON key file used to run
+	// the query. Relative names are resolved from the directory of the
+	// configuration file. If empty, application default credentials are used.
+	Credentials string `yaml:"credentials"`
+	// ImpersonateServiceAccount is the email of a service account to
+	// impersonate when running the query, using Credentials or application
+	// default credentials.
+	ImpersonateServiceAccount string `yaml:"impersonate_service_account"`
+	// Parameters are named query parameters, in addition to those set by the
+	// exporter for every query.
+	Parameters []Parameter `yaml:"parameters"`
+	// Vars are variables available to the query template, e.g. {{.Vars.name}}.
+	Vars map[string]string `yaml:"vars"`
+}
+
+// Columns declares the label and value columns of query results, instead of
+// treating columns named "value*" as values and all other columns as labels.
+type Columns struct {
+	// Labels are the names of the label columns.
+	Labels []string `yaml:"labels"`
+	// Values maps the names of the value columns to the suffixes added to the
+	// metric name, e.g. "_bytes". At most one suffix may be empty.
+	Values map[string]string `yaml:"values"`
+}
+
+// Value holds settings for a single value column of a query. Empty fields
+// default to the settings of the query.
+type Value struct {
+	// Help is the help text for the metric created from this column.
+	Help string `yaml:"help"`
+	// Unit is the unit of the column values.
+	Unit string `yaml:"unit"`
+}
+
+// HelpText returns the help text, including the unit, for the metric created
+// from the named value column. Column settings override query settings.
+func (q Query) HelpText(column string) string {
+	help, unit := q.Help, q.Unit
+	if v, ok := q.Values[column]; ok {
+		if v.Help != "" {
+			help = v.Help
+		}
+		if v.Unit != "" {
+			unit = v.Unit
+		}
+	}
+	if unit != "" {
+		help = strings.TrimSpace(help + " (" + unit + ")")
+	}
+	return help
+}
+
+// IsValueColumn returns true if column is a value column of q.
+func (q Query) IsValueColumn(column string) bool {
+	if q.Columns != nil {
+		_, ok := q.Columns.Values[column]
+		return ok
+	}
+	return strings.HasPrefix(column, "value")
+}
+
+// ValueSuffix returns the suffix added to the metric name for the value
+// column, e.g. "_bytes" for "value_bytes".
+func (q Query) ValueSuffix(column string) string {
+	if q.Columns != nil {
+		return q.Columns.Values[column]
+	}
+	return strings.TrimPrefix(column, "value")
+}
+
+// Config is the top level structure of a configuration file.
+type Config struct {
+	Queries []Query `yaml:"queries"`
+}
+
+// Load reads, parses and validates the named configuration file.
+func Load(filename string) (*Config, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(b, filepath.Dir(filename))
+}
+
+// Parse parses and validates the given configuration. Relative query file
+// names are resolved from dir.
+func Parse(b []byte, dir string) (*Config, error) {
+	c := &Config{}
+	// Since JSON is a subset of YAML, both formats are parsed the same way.
+	err := yaml.UnmarshalStrict(b, c)
+	if err != nil {
+		return nil, err
+	}
+	for i := range c.Queries {
+		q := &c.Queries[i]
+		if q.File != "" && !filepath.IsAbs(q.File) {
+			q.File = filepath.Join(dir, q.File)
+		}
+		if q.Credentials != "" && !filepath.IsAbs(q.Credentials) {
+			q.Credentials = filepath.Join(dir, q.Credentials)
+		}
+		if q.Name == "" && q.File != "" {
+			fname := filepath.Base(q.File)
+			q.Name = strings.TrimSuffix(fname, filepath.Ext(fname))
+		}
+		if q.Type == "" {
+			q.Type = Gauge
+		}
+	}
+	err = c.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Validate checks that every query is complete and that metric names are
+// unique.
+func (c *Config) Validate() error {
+	names := map[string]bool{}
+	for i, q := range c.Queries {
+		if q.Name == "" {
+			return fmt.Errorf("query %d: missing name", i)
+		}
+		if names[q.Name] {
+			return fmt.Errorf("query %q: duplicate name", q.Name)
+		}
+		names[q.Name] = true
+		err := q.Validate()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validate checks that the declared columns are valid for a query of type t.
+func (c *Columns) validate(t string) error {
+	if t != Gauge && t != Counter {
+		return fmt.Errorf("columns requires type %q or %q", Gauge, Counter)
+	}
+	if len(c.Values) == 0 {
+		return fmt.Errorf("columns must declare at least one value column")
+	}
+	labels := map[string]bool{}
+	for _, name := range c.Labels {
+		if !labelName.MatchString(name) || strings.HasPrefix(name, "__") {
+			return fmt.Errorf("invalid label column %q", name)
+		}
+		if _, ok := c.Values[name]; ok || labels[name] {
+			return fmt.Errorf("duplicate column %q", name)
+		}
+		labels[name] = true
+	}
+	suffixes := map[string]string{}
+	for column, suffix := range c.Values {
+		if !metricSuffix.MatchString(suffix) {
+			return fmt.Errorf("column %q: invalid suffix %q", column, suffix)
+		}
+		if other, ok := suffixes[suffix]; ok {
+			return fmt.Errorf("columns %q and %q have the same suffix %q", other, column, suffix)
+		}
+		suffixes[suffix] = column
+	}
+	return nil
+}
+
+// Validate checks that the settings of a single query are complete and
+// consistent.
+func (q Query) Validate() error {
+	if (q.File == "") == (q.SQL == "") {
+		return fmt.Errorf("query %q: exactly one of file or sql is required", q.Name)
+	}
+	switch q.Type {
+	case Gauge, Counter, Histogram, Summary:
+	default:
+		return fmt.Errorf("query %q: unsupported type %q", q.Name, q.Type)
+	}
+	switch q.CounterPolicy {
+	case "":
+	case CounterTotal, CounterDelta, CounterMax:
+		if q.Type != Counter {
+			return fmt.Errorf("query %q: counter_policy requires type %q", q.Name, Counter)
+		}
+	default:
+		return fmt.Errorf("query %q: unsupported counter_policy %q", q.Name, q.CounterPolicy)
+	}
+	switch q.Duplicates {
+	case "", DuplicateError, DuplicateFirst, DuplicateLast:
+	case DuplicateSum, DuplicateMax:
+		if q.Type != Gauge && q.Type != Counter {
+			return fmt.Errorf("query %q: duplicates %q requires type %q or %q", q.Name, q.Duplicates, Gauge, Counter)
+		}
+	default:
+		return fmt.Errorf("query %q: unsupported duplicates %q", q.Name, q.Duplicates)
+	}
+	if len(q.Quantiles) > 0 && q.Type != Summary {
+		return fmt.Errorf("query %q: quantiles requires type %q", q.Name, Summary)
+	}
+	for _, v := range q.Quantiles {
+		if v < 0 || v > 1 {
+			return fmt.Errorf("query %q: quantile %v must be between 0 and 1", q.Name, v)
+		}
+	}
+	for name := range q.Labels {
+		if !labelName.MatchString(name) || strings.HasPrefix(name, "__") {
+			return fmt.Errorf("query %q: invalid label name %q", q.Name, name)
+		}
+	}
+	if q.Columns != nil {
+		err := q.Columns.validate(q.Type)
+		if err != nil {
+			return fmt.Errorf("query %q: %v", q.Name, err)
+		}
+	}
+	for column := range q.Values {
+		if !q.IsValueColumn(column) {
+			return fmt.Errorf("query %q: %q is not a value column", q.Name, column)
+		}
+	}
+	if q.Refresh < 0 {
+		return fmt.Errorf("query %q: negative refresh %v", q.Name, q.Refresh)
+	}
+	if q.Timeout < 0 {
+		return fmt.Errorf("query %q: negative timeout %v", q.Name, q.Timeout)
+	}
+	if q.MaxBytesBilled < 0 {
+		return fmt.Errorf("query %q: negative max_bytes_billed %d", q.Name, q.MaxBytesBilled)
+	}
+	switch q.Priority {
+	case "", Interactive, Batch:
+	default:
+		return fmt.Errorf("query %q: unsupported priority %q", q.Name, q.Priority)
+	}
+	for k, v := range q.JobLabels {
+		if !jobLabelKey.MatchString(k) || !jobLabelValue.MatchString(v) {
+			return fmt.Errorf("query %q: invalid job label %q: %q", q.Name, k, v)
+		}
+	}
+	if q.JobIDPrefix != "" && !jobIDPrefix.MatchString(q.JobIDPrefix) {
+		return fmt.Errorf("query %q: invalid job_id_prefix %q", q.Name, q.JobIDPrefix)
+	}
+	switch q.NullLabels {
+	case "", NullEmpty, NullSkip:
+	default:
+		return fmt.Errorf("query %q: unsupported null_labels %q", q.Name, q.NullLabels)
+	}
+	switch q.NullValues {
+	case "", NullNaN, NullSkip, NullDefault:
+	default:
+		return fmt.Errorf("query %q: unsupported null_values %q", q.Name, q.NullValues)
+	}
+	if q.ImpersonateServiceAccount != "" && !strings.Contains(q.ImpersonateServiceAccount, "@") {
+		return fmt.Errorf("query %q: invalid impersonate_service_account %q", q.Name, q.ImpersonateServiceAccount)
+	}
+	params := map[string]bool{}
+	for _, p := range q.Parameters {
+		if err := p.validate(); err != nil {
+			return fmt.Errorf("query %q: %v", q.Name, err)
+		}
+		if params[p.Name] {
+			return fmt.Errorf("query %q: duplicate parameter %q", q.Name, p.Name)
+		}
+		params[p.Name] = true
+	}
+	return nil
+}
@@ -0,0 +1,409 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/rtx"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		want    *Config
+		wantErr bool
+	}{
+		{
+			name: "success-yaml",
+			config: `
+queries:
+- file: bq_example.sql
+  help: Example widgets.
+  unit: widgets
+  values:
+    value_bytes:
+      help: Size of widgets.
+      unit: bytes
+  refresh: 1h
+  timeout: 10m
+  max_bytes_billed: 1000000000
+  location: US
+  priority: BATCH
+  disable_query_cache: true
+  job_labels:
+    team: example
+  job_id_prefix: bqx_example
+  null_labels: skip
+  null_values: default
+  null_default: -1
+  labels:
+    team: example
+  project: mlab-sandbox
+  credentials: keys/example.json
+  impersonate_service_account: bqx@mlab-sandbox.iam.gserviceaccount.com
+  parameters:
+  - name: min_count
+    type: INT64
+    value: 10
+  - name: site
+    value: lga03
+  vars:
+    dataset: ndt
+- name: inline
+  type: counter
+  counter_policy: delta
+  duplicates: sum
+  sql: SELECT 1 AS value
+- name: declared
+  columns:
+    labels: [valuation]
+    values:
+      tests: ""
+      bytes: _bytes
+  values:
+    bytes:
+      unit: bytes
+  sql: SELECT "high" AS valuation, 1 AS tests, 2 AS bytes
+`,
+			want: &Config{
+				Queries: []Query{
+					{
+						Name: "bq_example",
+						Type: Gauge,
+						Help: "Example widgets.",
+						Unit: "widgets",
+						Values: map[string]Value{
+							"value_bytes": {Help: "Size of widgets.", Unit: "bytes"},
+						},
+						File:                      "/queries/bq_example.sql",
+						Refresh:                   time.Hour,
+						Timeout:                   10 * time.Minute,
+						Labels:                    map[string]string{"team": "example"},
+						MaxBytesBilled:            1000000000,
+						Location:                  "US",
+						Priority:                  Batch,
+						DisableQueryCache:         true,
+						JobLabels:                 map[string]string{"team": "example"},
+						JobIDPrefix:               "bqx_example",
+						NullLabels:                NullSkip,
+						NullValues:                NullDefault,
+						NullDefault:               -1,
+						Project:                   "mlab-sandbox",
+						Credentials:               "/queries/keys/example.json",
+						ImpersonateServiceAccount: "bqx@mlab-sandbox.iam.gserviceaccount.com",
+						Parameters: []Parameter{
+							{Name: "min_count", Type: Int64, Value: "10"},
+							{Name: "site", Value: "lga03"},
+						},
+						Vars: map[string]string{"dataset": "ndt"},
+					},
+					{
+						Name:          "inline",
+						Type:          Counter,
+						CounterPolicy: CounterDelta,
+						Duplicates:    DuplicateSum,
+						SQL:           "SELECT 1 AS value",
+					},
+					{
+						Name: "declared",
+						Type: Gauge,
+						Columns: &Columns{
+							Labels: []string{"valuation"},
+							Values: map[string]string{"tests": "", "bytes": "_bytes"},
+						},
+						Values: map[string]Value{"bytes": {Unit: "bytes"}},
+						SQL:    `SELECT "high" AS valuation, 1 AS tests, 2 AS bytes`,
+					},
+				},
+			},
+		},
+		{
+			name: "success-json-absolute-file",
+			config: `{"queries": [{"name": "abs", "file": "/other/abs.sql", "refresh": "30s"},
+				{"name": "sum", "type": "summary", "sql": "x", "quantiles": [0.5, 0.99]}]}`,
+			want: &Config{
+				Queries: []Query{
+					{Name: "abs", Type: Gauge, File: "/other/abs.sql", Refresh: 30 * time.Second},
+					{Name: "sum", Type: Summary, SQL: "x", Quantiles: []float64{0.5, 0.99}},
+				},
+			},
+		},
+		{
+			name:    "error-unknown-field",
+			config:  "queries:\n- name: a\n  sql: x\n  unknown: field\n",
+			wantErr: true,
+		},
+		{
+			name:    "error-missing-name",
+			config:  "queries:\n- sql: x\n",
+			wantErr: true,
+		},
+		{
+			name:    "error-duplicate-name",
+			config:  "queries:\n- name: a\n  sql: x\n- file: a.sql\n",
+			wantErr: true,
+		},
+		{
+			name:    "error-file-and-sql",
+			config:  "queries:\n- file: a.sql\n  sql: x\n",
+			wantErr: true,
+		},
+		{
+			name:    "error-no-file-or-sql",
+			config:  "queries:\n- name: a\n",
+			wantErr: true,
+		},
+		{
+			name:    "error-bad-type",
+			config:  "queries:\n- name: a\n  sql: x\n  type: meter\n",
+			wantErr: true,
+		},
+		{
+			name:    "error-counter-policy-for-gauge",
+			config:  "queries:\n- name: a\n  sql: x\n  counter_policy: max\n",
+			wantErr: true,
+		},
+		{
+			name:    "error-bad-counter-policy",
+			config:  "queries:\n- name: a\n  sql: x\n  type: counter\n  counter_policy: min\n",
+			wantErr: true,
+		},
+		{
+			name:    "error-quantiles-for-gauge",
+			config:  "queries:\n- name: a\n  sql: x\n  quantiles: [0.5]\n",
+			wantErr: true,
+		},
+		{
+			name:    "error-bad-quantile",
+			config:  "queries:\n- name: a\n  sql: x\n  type: summary\n  quantiles: [0.5, 50]\n",
+			wantErr: true,
+		},
+		{
+			name:    "error-invalid-label-name",
+			config:  "queries:\n- name: a\n  sql: x\n  labels:\n    bad-name: x\n",
+			wantErr: true,
+		},
+		{
+			name:    "error-reserved-label-name",
+			config:  "queries:\n- name: a\n  sql: x\n  labels:\n    __name: x\n",
+			wantErr: true,
+		},
+		{
+			name:    "error-values-not-value-column",
+			config:  "queries:\n- name: a\n  sql: x\n  values:\n    machine:\n      help: x\n",
+			wantErr: true,
+		},
+		{
+			name:    "error-negative-refresh",
+			config:  "queries:\n- name: a\n  sql: x\n  refresh: -1m\n",
+			wantErr: true,
+		},
+		{
+			name:    "error-negative-max-bytes-billed",
+			config:  "queries:\n- name: a\n  sql: x\n  max_bytes_billed: -1\n",
+			wantErr: true,
+		},
+		{
+			name:    "error-bad-priority",
+			config:  "queries:\n- name: a\n  sql: x\n  priority: urgent\n",
+			wantErr: true,
+		},
+		{
+			name:    "error-invalid-job-label",
+			config:  "queries:\n- name: a\n  sql: x\n  job_labels:\n    Team: x\n",
+			wantErr: true,
+		},
+		{
+			name:    "error-invalid-job-label-value",
+			config:  "queries:\n- name: a\n  sql: x\n  job_labels:\n    team: X Y\n",
+			wantErr: true,
+		},
+		{
+			name:    "error-invalid-job-id-prefix",
+			config:  "queries:\n- name: a\n  sql: x\n  job_id_prefix: bqx.a\n",
+			wantErr: true,
+		},
+		{
+			name:    "error-invalid-impersonate-service-account",
+			config:  "queries:\n- name: a\n  sql: x\n  impersonate_service_account: bqx\n",
+			wantErr: true,
+		},
+		{
+			name:    "error-bad-null-labels",
+			config:  "queries:\n- name: a\n  sql: x\n  null_labels: nan\n",
+			wantErr: true,
+		},
+		{
+			name:    "error-bad-null-values",
+			config:  "queries:\n- name: a\n  sql: x\n  null_values: empty\n",
+			wantErr: true,
+		},
+		{
+			name:    "error-columns-without-values",
+			config:  "queries:\n- name: a\n  sql: x\n  columns:\n    labels: [site]\n",
+			wantErr: true,
+		},
+		{
+			name:    "error-columns-histogram",
+			config:  "queries:\n- name: a\n  sql: x\n  type: histogram\n  columns:\n    values: {tests: ''}\n",
+			wantErr: true,
+		},
+		{
+			name:    "error-columns-invalid-label",
+			config:  "queries:\n- name: a\n  sql: x\n  columns:\n    labels: [__site]\n    values: {tests: ''}\n",
+			wantErr: true,
+		},
+		{
+			name:    "error-columns-duplicate-column",
+			config:  "queries:\n- name: a\n  sql: x\n  columns:\n    labels: [tests]\n    values: {tests: ''}\n",
+			wantErr: true,
+		},
+		{
+			name:    "error-columns-invalid-suffix",
+			config:  "queries:\n- name: a\n  sql: x\n  columns:\n    values: {tests: '-count'}\n",
+			wantErr: true,
+		},
+		{
+			name:    "error-columns-duplicate-suffix",
+			config:  "queries:\n- name: a\n  sql: x\n  columns:\n    values: {tests: '', count: ''}\n",
+			wantErr: true,
+		},
+		{
+			name:    "error-columns-undeclared-value-settings",
+			config:  "queries:\n- name: a\n  sql: x\n  columns:\n    values: {tests: ''}\n  values:\n    value: {unit: s}\n",
+			wantErr: true,
+		},
+		{
+			name:    "error-bad-duplicates",
+			config:  "queries:\n- name: a\n  sql: x\n  duplicates: min\n",
+			wantErr: true,
+		},
+		{
+			name:    "error-duplicates-sum-histogram",
+			config:  "queries:\n- name: a\n  sql: x\n  type: histogram\n  duplicates: sum\n",
+			wantErr: true,
+		},
+		{
+			name:    "error-negative-timeout",
+			config:  "queries:\n- name: a\n  sql: x\n  timeout: -1m\n",
+			wantErr: true,
+		},
+		{
+			name:    "error-reserved-parameter-name",
+			config:  "queries:\n- name: a\n  sql: x\n  parameters:\n  - name: now\n",
+			wantErr: true,
+		},
+		{
+			name:    "error-invalid-parameter-name",
+			config:  "queries:\n- name: a\n  sql: x\n  parameters:\n  - name: bad-name\n",
+			wantErr: true,
+		},
+		{
+			name:    "error-duplicate-parameter",
+			config:  "queries:\n- name: a\n  sql: x\n  parameters:\n  - name: b\n  - name: b\n",
+			wantErr: true,
+		},
+		{
+			name:    "error-bad-parameter-type",
+			config:  "queries:\n- name: a\n  sql: x\n  parameters:\n  - name: b\n    type: FLOAT64\n",
+			wantErr: true,
+		},
+		{
+			name:    "error-bad-parameter-value",
+			config:  "queries:\n- name: a\n  sql: x\n  parameters:\n  - name: b\n    type: TIMESTAMP\n    value: yesterday\n",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Parse([]byte(tt.config), "/queries")
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Parse() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Parse() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config_test_*")
+	rtx.Must(err, "Failed to create temp dir")
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "config.yml")
+	rtx.Must(ioutil.WriteFile(name, []byte("queries:\n- file: q.sql\n"), 0644), "Failed to write config")
+
+	c, err := Load(name)
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if c.Queries[0].File != filepath.Join(dir, "q.sql") {
+		t.Errorf("Load() file = %q, want %q", c.Queries[0].File, filepath.Join(dir, "q.sql"))
+	}
+	_, err = Load(filepath.Join(dir, "missing.yml"))
+	if err == nil {
+		t.Errorf("Load() expected error for missing file")
+	}
+}
+
+func TestQuery_HelpText(t *testing.T) {
+	q := Query{
+		Help: "Widgets.",
+		Unit: "widgets",
+		Values: map[string]Value{
+			"value_bytes": {Help: "Size of widgets.", Unit: "bytes"},
+			"value_total": {Help: "Total widgets."},
+		},
+	}
+	tests := []struct {
+		column string
+		want   string
+	}{
+		{column: "", want: "Widgets. (widgets)"},
+		{column: "value", want: "Widgets. (widgets)"},
+		{column: "value_bytes", want: "Size of widgets. (bytes)"},
+		{column: "value_total", want: "Total widgets. (widgets)"},
+	}
+	for _, tt := range tests {
+		if got := q.HelpText(tt.column); got != tt.want {
+			t.Errorf("HelpText(%q) = %q, want %q", tt.column, got, tt.want)
+		}
+	}
+	if got := (Query{}).HelpText("value"); got != "" {
+		t.Errorf("HelpText() = %q, want empty", got)
+	}
+}
+
+func TestQuery_ValueSuffix(t *testing.T) {
+	declared := Query{Columns: &Columns{Values: map[string]string{"tests": "_count", "bytes": ""}}}
+	tests := []struct {
+		name      string
+		query     Query
+		column    string
+		want      string
+		wantValue bool
+	}{
+		{name: "prefix-value", column: "value", want: "", wantValue: true},
+		{name: "prefix-suffix", column: "value_bytes", want: "_bytes", wantValue: true},
+		{name: "declared-value", query: declared, column: "tests", want: "_count", wantValue: true},
+		{name: "declared-empty-suffix", query: declared, column: "bytes", want: "", wantValue: true},
+		{name: "declared-undeclared-value", query: declared, column: "value", want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.query.ValueSuffix(tt.column); got != tt.want {
+				t.Errorf("Query.ValueSuffix() = %q, want %q", got, tt.want)
+			}
+			if got := tt.query.IsValueColumn(tt.column); got != tt.wantValue {
+				t.Errorf("Query.IsValueColumn() = %v, want %v", got, tt.wantValue)
+			}
+		})
+	}
+}
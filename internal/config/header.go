@@ -0,0 +1,80 @@
+package config
+
+import (
+	"strings"
+)
+
+// ParseHeader reads metric metadata from the leading SQL comments of a query
+// and adds it to q. Settings already present in q take precedence. Supported
+// comments are:
+//
+//	-- help: <help text for all metrics>
+//	-- unit: <unit for all metrics>
+//	-- help_<value column>: <help text for the metric from value column>
+//	-- unit_<value column>: <unit for the metric from value column>
+//	-- label_<name>: <value of a constant label added to all metrics>
+//
+// Parsing stops at the first line that is not a comment or empty.
+func (q *Query) ParseHeader(sql string) {
+	for _, line := range strings.Split(sql, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if !strings.HasPrefix(line, "--") {
+			return
+		}
+		fields := strings.SplitN(strings.TrimPrefix(line, "--"), ":", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		key, text := strings.TrimSpace(fields[0]), strings.TrimSpace(fields[1])
+		switch {
+		case key == "help" && q.Help == "":
+			q.Help = text
+		case key == "unit" && q.Unit == "":
+			q.Unit = text
+		case strings.HasPrefix(key, "help_") && q.IsValueColumn(strings.TrimPrefix(key, "help_")):
+			q.setValue(strings.TrimPrefix(key, "help_"), func(v *Value) {
+				if v.Help == "" {
+					v.Help = text
+				}
+			})
+		case strings.HasPrefix(key, "unit_") && q.IsValueColumn(strings.TrimPrefix(key, "unit_")):
+			q.setValue(strings.TrimPrefix(key, "unit_"), func(v *Value) {
+				if v.Unit == "" {
+					v.Unit = text
+				}
+			})
+		case strings.HasPrefix(key, "label_"):
+			q.setLabel(strings.TrimPrefix(key, "label_"), text)
+		}
+	}
+}
+
+// setValue applies set to the settings of the named value column. The Values
+// map is copied first so that copies of q do not share header settings.
+func (q *Query) setValue(column string, set func(v *Value)) {
+	values := make(map[string]Value, len(q.Values)+1)
+	for k, v := range q.Values {
+		values[k] = v
+	}
+	v := values[column]
+	set(&v)
+	values[column] = v
+	q.Values = values
+}
+
+// setLabel adds a constant label to q unless it is already configured. The
+// Labels map is copied first so that copies of q do not share header settings.
+func (q *Query) setLabel(name, value string) {
+	if _, ok := q.Labels[name]; ok {
+		return
+	}
+	labels := make(map[string]string, len(q.Labels)+1)
+	for k, v := range q.Labels {
+		labels[k] = v
+	}
+	labels[name] = value
+	q.Labels = labels
+}
@@ -0,0 +1,87 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestQuery_ParseHeader(t *testing.T) {
+	tests := []struct {
+		name  string
+		query Query
+		sql   string
+		want  Query
+	}{
+		{
+			name: "success",
+			sql: `-- Example query.
+-- help: Number of widgets.
+-- unit: widgets
+--help_value_bytes:  Size of widgets.
+-- unit_value_bytes: bytes
+-- label_team: widgets
+
+SELECT 1 AS value, 2 AS value_bytes
+-- help: ignored after the header.
+`,
+			want: Query{
+				Help: "Number of widgets.",
+				Unit: "widgets",
+				Values: map[string]Value{
+					"value_bytes": {Help: "Size of widgets.", Unit: "bytes"},
+				},
+				Labels: map[string]string{"team": "widgets"},
+			},
+		},
+		{
+			name: "config-takes-precedence",
+			query: Query{
+				Help:   "Configured help.",
+				Values: map[string]Value{"value": {Help: "Configured value help."}},
+				Labels: map[string]string{"team": "configured"},
+			},
+			sql: "-- help: Header help.\n-- help_value: Header value help.\n-- unit_value: seconds\n" +
+				"-- label_team: header\n-- label_env: prod\n",
+			want: Query{
+				Help:   "Configured help.",
+				Values: map[string]Value{"value": {Help: "Configured value help.", Unit: "seconds"}},
+				Labels: map[string]string{"team": "configured", "env": "prod"},
+			},
+		},
+		{
+			name:  "declared-columns",
+			query: Query{Columns: &Columns{Values: map[string]string{"tests": "_count"}}},
+			sql:   "-- help_tests: Number of tests.\n-- help_value: Not a value column.\n",
+			want: Query{
+				Columns: &Columns{Values: map[string]string{"tests": "_count"}},
+				Values:  map[string]Value{"tests": {Help: "Number of tests."}},
+			},
+		},
+		{
+			name: "no-header",
+			sql:  "SELECT 1 AS value -- help: not a header",
+			want: Query{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := tt.query
+			q.ParseHeader(tt.sql)
+			if !reflect.DeepEqual(q, tt.want) {
+				t.Errorf("ParseHeader() = %#v, want %#v", q, tt.want)
+			}
+		})
+	}
+}
+
+func TestQuery_ParseHeaderCopiesValues(t *testing.T) {
+	orig := Query{
+		Values: map[string]Value{"value": {Help: "help"}},
+		Labels: map[string]string{"team": "widgets"},
+	}
+	q := orig
+	q.ParseHeader("-- unit_value: seconds\n-- label_env: prod\n")
+	if orig.Values["value"].Unit != "" || len(orig.Labels) != 1 {
+		t.Errorf("ParseHeader() modified the original query: %#v", orig)
+	}
+}
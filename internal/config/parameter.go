@@ -0,0 +1,72 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// Supported query parameter types.
+const (
+	Int64     = "INT64"
+	Timestamp = "TIMESTAMP"
+	String    = "STRING"
+)
+
+// Parameters set by the exporter for every query. Query parameters from the
+// configuration may not use these names.
+const (
+	// StartTimeParameter is the TIMESTAMP when the exporter started.
+	StartTimeParameter = "start_time"
+	// RefreshRateParameter is the INT64 refresh interval of the query, in
+	// seconds.
+	RefreshRateParameter = "refresh_rate_sec"
+	// NowParameter is the TIMESTAMP when the query is run.
+	NowParameter = "now"
+)
+
+// parameterName matches valid BigQuery query parameter names.
+var parameterName = regexp.MustCompile("^[a-zA-Z_][a-zA-Z0-9_]*$")
+
+// Parameter is a named query parameter, referenced in queries as @name.
+type Parameter struct {
+	// Name is the parameter name, without the leading '@'.
+	Name string `yaml:"name"`
+	// Type is the parameter type: INT64, TIMESTAMP or STRING. If empty,
+	// STRING is used.
+	Type string `yaml:"type"`
+	// Value is the parameter value. TIMESTAMP values use the RFC 3339 format,
+	// e.g. "2020-01-01T00:00:00Z".
+	Value string `yaml:"value"`
+}
+
+// Parse returns the value of the parameter as an int64, time.Time or string,
+// according to the parameter type.
+func (p Parameter) Parse() (interface{}, error) {
+	switch p.Type {
+	case Int64:
+		return strconv.ParseInt(p.Value, 10, 64)
+	case Timestamp:
+		return time.Parse(time.RFC3339, p.Value)
+	case String, "":
+		return p.Value, nil
+	default:
+		return nil, fmt.Errorf("unsupported type %q", p.Type)
+	}
+}
+
+// validate checks the parameter name and value.
+func (p Parameter) validate() error {
+	switch p.Name {
+	case StartTimeParameter, RefreshRateParameter, NowParameter:
+		return fmt.Errorf("parameter name %q is reserved", p.Name)
+	}
+	if !parameterName.MatchString(p.Name) {
+		return fmt.Errorf("invalid parameter name %q", p.Name)
+	}
+	if _, err := p.Parse(); err != nil {
+		return fmt.Errorf("parameter %q: %v", p.Name, err)
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParameter_Parse(t *testing.T) {
+	tests := []struct {
+		name    string
+		p       Parameter
+		want    interface{}
+		wantErr bool
+	}{
+		{
+			name: "int64",
+			p:    Parameter{Name: "a", Type: Int64, Value: "-10"},
+			want: int64(-10),
+		},
+		{
+			name: "timestamp",
+			p:    Parameter{Name: "a", Type: Timestamp, Value: "2020-01-02T03:04:05Z"},
+			want: time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+		},
+		{
+			name: "string",
+			p:    Parameter{Name: "a", Type: String, Value: "x"},
+			want: "x",
+		},
+		{
+			name: "default-string",
+			p:    Parameter{Name: "a", Value: "10"},
+			want: "10",
+		},
+		{
+			name:    "error-int64",
+			p:       Parameter{Name: "a", Type: Int64, Value: "1.5"},
+			wantErr: true,
+		},
+		{
+			name:    "error-type",
+			p:       Parameter{Name: "a", Type: "BOOL", Value: "true"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.p.Parse()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Parameter.Parse() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Parameter.Parse() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
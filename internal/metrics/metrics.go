@@ -0,0 +1,189 @@
+// Package metrics defines the prometheus metrics used to monitor the queries
+// run by the bigquery_exporter itself.
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	// QueryDuration measures the run time of every query.
+	//
+	// Provides metrics:
+	//   bqx_query_duration_seconds{query}
+	// Example usage:
+	//   metrics.QueryDuration.WithLabelValues(name).Observe(d.Seconds())
+	QueryDuration = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "bqx_query_duration_seconds",
+			Help:    "Time to run a query and read all results.",
+			Buckets: prometheus.ExponentialBuckets(0.25, 2, 16),
+		},
+		[]string{"query"},
+	)
+
+	// QueryLastSuccess records the time of the last successful run of every
+	// query.
+	//
+	// Provides metrics:
+	//   bqx_query_last_success_timestamp_seconds{query}
+	// Example usage:
+	//   metrics.QueryLastSuccess.WithLabelValues(name).SetToCurrentTime()
+	QueryLastSuccess = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "bqx_query_last_success_timestamp_seconds",
+			Help: "Unix time of the last successful query run.",
+		},
+		[]string{"query"},
+	)
+
+	// QueryErrors counts the failed runs of every query.
+	//
+	// Provides metrics:
+	//   bqx_query_errors_total{query}
+	// Example usage:
+	//   metrics.QueryErrors.WithLabelValues(name).Inc()
+	QueryErrors = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "bqx_query_errors_total",
+			Help: "Number of failed query runs.",
+		},
+		[]string{"query"},
+	)
+
+	// QueryRows records the number of rows returned by the last successful
+	// run of every query.
+	//
+	// Provides metrics:
+	//   bqx_query_rows{query}
+	// Example usage:
+	//   metrics.QueryRows.WithLabelValues(name).Set(float64(len(rows)))
+	QueryRows = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "bqx_query_rows",
+			Help: "Number of rows returned by the last successful query run.",
+		},
+		[]string{"query"},
+	)
+
+	// QueryBytesProcessed counts the bytes processed by BigQuery jobs.
+	//
+	// Provides metrics:
+	//   bqx_query_bytes_processed_total{query}
+	// Example usage:
+	//   metrics.QueryBytesProcessed.WithLabelValues(name).Add(bytes)
+	QueryBytesProcessed = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "bqx_query_bytes_processed_total",
+			Help: "Number of bytes processed by query jobs.",
+		},
+		[]string{"query"},
+	)
+
+	// QueryBytesBilled counts the bytes billed for BigQuery jobs.
+	//
+	// Provides metrics:
+	//   bqx_query_bytes_billed_total{query}
+	// Example usage:
+	//   metrics.QueryBytesBilled.WithLabelValues(name).Add(bytes)
+	QueryBytesBilled = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "bqx_query_bytes_billed_total",
+			Help: "Number of bytes billed for query jobs.",
+		},
+		[]string{"query"},
+	)
+
+	// QueryCacheHit reports whether the last BigQuery job of every query was
+	// served from the query cache.
+	//
+	// Provides metrics:
+	//   bqx_query_cache_hit{query}
+	// Example usage:
+	//   metrics.QueryCacheHit.WithLabelValues(name).Set(1)
+	QueryCacheHit = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "bqx_query_cache_hit",
+			Help: "Whether the last query job was served from cache (1) or not (0).",
+		},
+		[]string{"query"},
+	)
+
+	// QueryEstimatedBytes records the bytes processed by every query, as
+	// estimated by a dry run when the query is loaded.
+	//
+	// Provides metrics:
+	//   bqx_query_estimated_bytes{query}
+	// Example usage:
+	//   metrics.QueryEstimatedBytes.WithLabelValues(name).Set(bytes)
+	QueryEstimatedBytes = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "bqx_query_estimated_bytes",
+			Help: "Bytes processed by a query, estimated by a dry run when loaded.",
+		},
+		[]string{"query"},
+	)
+
+	// QueryOverBudget counts the queries refused because their estimated
+	// bytes processed are greater than the maximum bytes billed.
+	//
+	// Provides metrics:
+	//   bqx_query_over_budget_total{query}
+	// Example usage:
+	//   metrics.QueryOverBudget.WithLabelValues(name).Inc()
+	QueryOverBudget = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "bqx_query_over_budget_total",
+			Help: "Number of query runs refused for exceeding the maximum bytes billed.",
+		},
+		[]string{"query"},
+	)
+
+	// DuplicateSeries counts the query results with the same label values as
+	// a previous result of the same query run.
+	//
+	// Provides metrics:
+	//   bqx_query_duplicate_series_total{query}
+	// Example usage:
+	//   metrics.DuplicateSeries.WithLabelValues(name).Add(duplicates)
+	DuplicateSeries = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "bqx_query_duplicate_series_total",
+			Help: "Number of query results with duplicate label values.",
+		},
+		[]string{"query"},
+	)
+
+	// RowsDropped counts the query result rows skipped by the NULL policies
+	// of every query, by the reason they were skipped, "null_label" or
+	// "null_value".
+	//
+	// Provides metrics:
+	//   bqx_query_rows_dropped_total{query, reason}
+	// Example usage:
+	//   metrics.RowsDropped.WithLabelValues(name, "null_value").Inc()
+	RowsDropped = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "bqx_query_rows_dropped_total",
+			Help: "Number of query result rows skipped for NULL labels or values.",
+		},
+		[]string{"query", "reason"},
+	)
+
+	// RegisterErrors counts the failures to load or register a new version of
+	// every query. While registration fails, the previous version of a query
+	// continues to be served.
+	//
+	// Provides metrics:
+	//   bqx_query_register_errors_total{query, reason}
+	// Example usage:
+	//   metrics.RegisterErrors.WithLabelValues(name, "conflict").Inc()
+	RegisterErrors = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "bqx_query_register_errors_total",
+			Help: "Number of failures to load or register a query.",
+		},
+		[]string{"query", "reason"},
+	)
+)
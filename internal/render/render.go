@@ -0,0 +1,98 @@
+// Package render renders query text as a Go text/template, so that one query
+// may be used for many datasets or date-sharded tables.
+package render
+
+import (
+	"os"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Context is the data available to query templates, e.g. {{.Now}}.
+type Context struct {
+	// Now is the time the query is rendered, in UTC.
+	Now time.Time
+	// WindowStart and WindowEnd are the start and end of the last complete
+	// refresh interval before Now, in UTC. Because queries are run at refresh
+	// boundaries, WindowEnd is normally the time of the current run.
+	WindowStart time.Time
+	WindowEnd   time.Time
+	// StartTime is the time the exporter started, in UTC.
+	StartTime time.Time
+	// Refresh is the refresh interval of the query.
+	Refresh time.Duration
+	// Env holds the environment variables of the exporter, e.g.
+	// {{.Env.PROJECT}}.
+	Env map[string]string
+	// Vars holds the variables of the query from the configuration file, e.g.
+	// {{.Vars.dataset}}.
+	Vars map[string]string
+}
+
+// At returns a copy of the context for rendering a query at time now. The
+// window is aligned to multiples of the Refresh interval, like the scheduler
+// that runs queries.
+func (c Context) At(now time.Time) Context {
+	c.Now = now.UTC()
+	c.WindowEnd = c.Now
+	if c.Refresh > 0 {
+		c.WindowEnd = c.Now.Truncate(c.Refresh)
+	}
+	c.WindowStart = c.WindowEnd.Add(-c.Refresh)
+	return c
+}
+
+// Funcs are the helper functions available to query templates.
+//
+//	date layout t  - formats the time t in UTC with the Go time layout.
+//	suffix t       - formats the time t as a date-sharded table suffix,
+//	                 e.g. "20200102".
+//	addDays n t    - adds n days to the time t.
+//
+// For example, the table for yesterday is:
+//
+//	`dataset.table_{{.Now | addDays -1 | suffix}}`
+var Funcs = template.FuncMap{
+	"date":    date,
+	"suffix":  suffix,
+	"addDays": addDays,
+}
+
+func date(layout string, t time.Time) string {
+	return t.UTC().Format(layout)
+}
+
+func suffix(t time.Time) string {
+	return date("20060102", t)
+}
+
+func addDays(n int, t time.Time) time.Time {
+	return t.AddDate(0, 0, n)
+}
+
+// Query renders the query text using the given context. Using a missing
+// variable is an error.
+func Query(name, text string, ctx Context) (string, error) {
+	t, err := template.New(name).Funcs(Funcs).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	err = t.Execute(&b, ctx)
+	if err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// Environ returns the environment variables of the exporter, by name.
+func Environ() map[string]string {
+	env := map[string]string{}
+	for _, kv := range os.Environ() {
+		if i := strings.Index(kv, "="); i > 0 {
+			env[kv[:i]] = kv[i+1:]
+		}
+	}
+	return env
+}
@@ -0,0 +1,114 @@
+package render
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestQuery(t *testing.T) {
+	ctx := Context{
+		Now:       time.Date(2020, 3, 1, 12, 30, 0, 0, time.UTC),
+		StartTime: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+		Refresh:   5 * time.Minute,
+		Env:       map[string]string{"PROJECT": "mlab-sandbox"},
+		Vars:      map[string]string{"dataset": "ndt"},
+	}
+	tests := []struct {
+		name    string
+		text    string
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "no-template",
+			text: "SELECT 1 AS value",
+			want: "SELECT 1 AS value",
+		},
+		{
+			name: "vars-and-env",
+			text: "FROM `{{.Env.PROJECT}}.{{.Vars.dataset}}.web100`",
+			want: "FROM `mlab-sandbox.ndt.web100`",
+		},
+		{
+			name: "date-sharded-table",
+			text: "FROM `ndt.table_{{.Now | addDays -1 | suffix}}`",
+			want: "FROM `ndt.table_20200229`",
+		},
+		{
+			name: "date-and-refresh",
+			text: `{{date "2006-01-02" .StartTime}} {{.Refresh.Seconds}}`,
+			want: "2020-01-01 300",
+		},
+		{
+			name:    "error-missing-var",
+			text:    "{{.Vars.missing}}",
+			wantErr: true,
+		},
+		{
+			name:    "error-parse",
+			text:    "{{.Vars.dataset",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Query(tt.name, tt.text, ctx)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Query() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("Query() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestContext_At(t *testing.T) {
+	tests := []struct {
+		name      string
+		refresh   time.Duration
+		now       time.Time
+		wantStart time.Time
+		wantEnd   time.Time
+	}{
+		{
+			name:      "aligned-to-refresh",
+			refresh:   5 * time.Minute,
+			now:       time.Date(2020, 3, 1, 12, 32, 10, 0, time.UTC),
+			wantStart: time.Date(2020, 3, 1, 12, 25, 0, 0, time.UTC),
+			wantEnd:   time.Date(2020, 3, 1, 12, 30, 0, 0, time.UTC),
+		},
+		{
+			name:      "at-boundary",
+			refresh:   time.Hour,
+			now:       time.Date(2020, 3, 1, 12, 0, 0, 0, time.UTC),
+			wantStart: time.Date(2020, 3, 1, 11, 0, 0, 0, time.UTC),
+			wantEnd:   time.Date(2020, 3, 1, 12, 0, 0, 0, time.UTC),
+		},
+		{
+			name:      "no-refresh",
+			now:       time.Date(2020, 3, 1, 12, 0, 1, 0, time.UTC),
+			wantStart: time.Date(2020, 3, 1, 12, 0, 1, 0, time.UTC),
+			wantEnd:   time.Date(2020, 3, 1, 12, 0, 1, 0, time.UTC),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := Context{Refresh: tt.refresh}.At(tt.now)
+			if !c.Now.Equal(tt.now) || !c.WindowStart.Equal(tt.wantStart) || !c.WindowEnd.Equal(tt.wantEnd) {
+				t.Errorf("Context.At() = %v %v %v, want %v %v %v",
+					c.Now, c.WindowStart, c.WindowEnd, tt.now, tt.wantStart, tt.wantEnd)
+			}
+		})
+	}
+}
+
+func TestEnviron(t *testing.T) {
+	os.Setenv("RENDER_TEST_VAR", "a=b")
+	defer os.Unsetenv("RENDER_TEST_VAR")
+	if got := Environ()["RENDER_TEST_VAR"]; got != "a=b" {
+		t.Errorf("Environ() RENDER_TEST_VAR = %q, want %q", got, "a=b")
+	}
+}
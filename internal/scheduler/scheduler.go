@@ -0,0 +1,66 @@
+// Package scheduler runs periodic jobs, each on its own interval. A slow job
+// never delays any other job.
+package scheduler
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+type job struct {
+	interval time.Duration
+	run      func(ctx context.Context)
+}
+
+// Scheduler manages a set of periodic jobs.
+type Scheduler struct {
+	jobs []job
+}
+
+// New creates a new, empty Scheduler.
+func New() *Scheduler {
+	return &Scheduler{}
+}
+
+// Add adds a job to the scheduler. The job is run once when the scheduler
+// starts, and then at every following multiple of interval. Runs of the same
+// job never overlap; if a run takes longer than interval, the next run starts
+// at the next multiple of interval after the current run completes.
+func (s *Scheduler) Add(interval time.Duration, run func(ctx context.Context)) {
+	s.jobs = append(s.jobs, job{interval: interval, run: run})
+}
+
+// Run starts all jobs and blocks until ctx is cancelled and every running job
+// has returned.
+func (s *Scheduler) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for i := range s.jobs {
+		wg.Add(1)
+		go func(j job) {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				j.run(ctx)
+				sleepUntilNext(ctx, j.interval)
+			}
+		}(s.jobs[i])
+	}
+	wg.Wait()
+}
+
+// Next returns the nearest time after t that is a multiple of the given
+// duration.
+func Next(t time.Time, d time.Duration) time.Time {
+	return t.Truncate(d).Add(d)
+}
+
+// sleepUntilNext sleeps until the next multiple of the given duration, or
+// until ctx is cancelled.
+func sleepUntilNext(ctx context.Context, d time.Duration) {
+	timer := time.NewTimer(time.Until(Next(time.Now(), d)))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+}
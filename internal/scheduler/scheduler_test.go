@@ -0,0 +1,75 @@
+package scheduler
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestNext(t *testing.T) {
+	base := time.Date(2020, 1, 1, 1, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		t    time.Time
+		d    time.Duration
+		want time.Time
+	}{
+		{
+			name: "aligned-time-returns-next-interval",
+			t:    base,
+			d:    time.Minute,
+			want: base.Add(time.Minute),
+		},
+		{
+			name: "unaligned-time",
+			t:    base.Add(90 * time.Second),
+			d:    time.Minute,
+			want: base.Add(2 * time.Minute),
+		},
+		{
+			name: "hourly",
+			t:    base.Add(59 * time.Minute),
+			d:    time.Hour,
+			want: base.Add(time.Hour),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Next(tt.t, tt.d); !got.Equal(tt.want) {
+				t.Errorf("Next() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestScheduler_Run(t *testing.T) {
+	var fast, slow int32
+	s := New()
+	s.Add(10*time.Millisecond, func(ctx context.Context) {
+		atomic.AddInt32(&fast, 1)
+	})
+	s.Add(10*time.Millisecond, func(ctx context.Context) {
+		atomic.AddInt32(&slow, 1)
+		// Block until the scheduler is stopped.
+		<-ctx.Done()
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	s.Run(ctx)
+
+	if slow != 1 {
+		t.Errorf("Run() slow job ran %d times, want 1", slow)
+	}
+	// The fast job must not wait on the slow job.
+	if fast < 5 {
+		t.Errorf("Run() fast job ran %d times, want at least 5", fast)
+	}
+}
+
+func TestScheduler_RunNoJobs(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	New().Run(ctx)
+}
@@ -1,11 +1,15 @@
 package setup
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"os"
+	"sync"
 
 	"github.com/m-lab/go/logx"
+	"github.com/m-lab/prometheus-bigquery-exporter/internal/config"
 	"github.com/m-lab/prometheus-bigquery-exporter/sql"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/spf13/afero"
@@ -16,15 +20,59 @@ var fs = afero.NewOsFs()
 // File represents a query file and related metadata to keep it up to date and
 // registered with the prometheus collector registry.
 type File struct {
+	// Name is the query file name. Name is empty for inline queries.
 	Name string
-	stat os.FileInfo
-	c    *sql.Collector
+	// Query is the configuration for this query.
+	Query config.Query
+	// Registerer is the registry for the collectors of this file. If nil,
+	// prometheus.DefaultRegisterer is used.
+	Registerer prometheus.Registerer
+	stat       os.FileInfo
+	c          *sql.Collector
+	// unchecked reports the metrics of unchecked collectors.
+	unchecked *uncheckedCollector
+}
+
+// uncheckedCollector is registered once for a file with unchecked collectors,
+// and reports the metrics of the current collector. Because the unchecked
+// collector is never unregistered, the current collector can be replaced
+// without changing the registry.
+type uncheckedCollector struct {
+	mux sync.Mutex
+	c   *sql.Collector
+}
+
+// Describe satisfies the prometheus.Collector interface. Describe reports no
+// descriptions, so that the collector is registered as unchecked.
+func (u *uncheckedCollector) Describe(ch chan<- *prometheus.Desc) {}
+
+// Collect satisfies the prometheus.Collector interface. Collect reports the
+// metrics of the current collector.
+func (u *uncheckedCollector) Collect(ch chan<- prometheus.Metric) {
+	u.mux.Lock()
+	c := u.c
+	u.mux.Unlock()
+	if c != nil {
+		c.Collect(ch)
+	}
+}
+
+// set replaces the current collector.
+func (u *uncheckedCollector) set(c *sql.Collector) {
+	u.mux.Lock()
+	defer u.mux.Unlock()
+	u.c = c
 }
 
 // IsModified reports true if the file has been modified since the last call.
 // The first call should almost always return false.
 func (f *File) IsModified() (bool, error) {
 	var err error
+	if f.Name == "" {
+		// Inline queries cannot change, so they are only modified until the
+		// first successful registration.
+		return f.c == nil, nil
+	}
 	if f.stat == nil {
 		f.stat, err = fs.Stat(f.Name)
 		logx.Debug.Println("IsModified:stat1:", f.Name, err)
@@ -46,35 +94,131 @@ func (f *File) IsModified() (bool, error) {
 	return modified, nil
 }
 
+// Errors returned by Register.
+var (
+	// ErrQuery is returned when the collector query fails.
+	ErrQuery = errors.New("query failed")
+	// ErrEmptyResult is returned when the collector query returns no metrics
+	// and the result schema is unknown, so no metric descriptors can be
+	// created.
+	ErrEmptyResult = errors.New("empty query result")
+	// ErrUnregister is returned when the previous collector cannot be
+	// unregistered.
+	ErrUnregister = errors.New("failed to unregister collector")
+	// ErrConflict is returned when the collector metrics conflict with those
+	// of another registered collector, e.g. when a query changes its labels.
+	ErrConflict = errors.New("collector registration conflict")
+)
+
 // Register the given collector. If a collector was previously registered with
-// this file, then it is unregistered first. If either registration or
-// unregister fails, then the error is returned.
-func (f *File) Register(c *sql.Collector) error {
+// this file, then it is replaced by the given collector. If the new collector
+// cannot be registered, then the previous collector remains registered and
+// the error is returned. After ErrQuery or ErrEmptyResult, which may succeed
+// later, the next call to IsModified reports true, so that registration of the
+// current file is attempted again. Other errors, such as ErrConflict, cannot
+// succeed until the file changes, so registration waits for the next change.
+// The collector query is run once using ctx, and its success is only recorded
+// once c is registered.
+func (f *File) Register(ctx context.Context, c *sql.Collector) error {
+	err := f.register(ctx, c)
+	if errors.Is(err, ErrQuery) || errors.Is(err, ErrEmptyResult) {
+		f.Reset()
+	}
+	return err
+}
+
+// Reset clears the saved file state, so that the next call to IsModified
+// reports true for a file that exists.
+func (f *File) Reset() {
+	f.stat = nil
+}
+
+// registerer returns the registry for the collectors of this file.
+func (f *File) registerer() prometheus.Registerer {
+	if f.Registerer == nil {
+		return prometheus.DefaultRegisterer
+	}
+	return f.Registerer
+}
+
+func (f *File) register(ctx context.Context, c *sql.Collector) error {
+	if c.Unchecked {
+		return f.replace(ctx, c)
+	}
+	// Run the collector query once to create the descriptors, so that the
+	// results are checked before changing any registration.
+	err := c.Load(ctx)
+	if err != nil {
+		return fmt.Errorf("%w: %q: %v", ErrQuery, f.Query.Name, err)
+	}
+	if describe(c) == 0 {
+		return fmt.Errorf("%w: %q", ErrEmptyResult, f.Query.Name)
+	}
 	if f.c != nil {
-		ok := prometheus.Unregister(f.c)
+		ok := f.registerer().Unregister(f.c)
 		logx.Debug.Println("Unregister:", ok)
 		if !ok {
-			// This is a fatal error. If the
-			return fmt.Errorf("failed to unregister %q", f.Name)
+			return fmt.Errorf("%w: %q", ErrUnregister, f.Query.Name)
 		}
-		f.c = nil
 	}
-	// Register runs c.Update().
-	err := prometheus.Register(c)
+	err = f.registerer().Register(c)
 	if err != nil {
-		// While collector Update could fail transiently, this may be a fatal error.
-		return err
+		if f.c != nil {
+			// Restore the previous collector, which registered successfully
+			// before, so that its metrics continue to be served.
+			rerr := f.registerer().Register(f.c)
+			logx.Debug.Println("Restore:", f.Query.Name, rerr)
+		}
+		return fmt.Errorf("%w: %q: %v", ErrConflict, f.Query.Name, err)
 	}
-	logx.Debug.Println("Register:", f.Name, c.RegisterErr)
+	logx.Debug.Println("Register:", f.Name)
 	// Save the registered collector.
 	f.c = c
-	return c.RegisterErr
+	c.RecordSuccess()
+	return nil
+}
+
+// replace runs the query of the unchecked collector c and, if successful,
+// replaces the current collector. The registry is only changed on the first
+// successful call, to register the unchecked collector for this file.
+func (f *File) replace(ctx context.Context, c *sql.Collector) error {
+	err := c.Load(ctx)
+	if err != nil {
+		return fmt.Errorf("%w: %q: %v", ErrQuery, f.Query.Name, err)
+	}
+	if f.unchecked == nil {
+		u := &uncheckedCollector{}
+		err = f.registerer().Register(u)
+		if err != nil {
+			return fmt.Errorf("%w: %q: %v", ErrConflict, f.Query.Name, err)
+		}
+		f.unchecked = u
+	}
+	logx.Debug.Println("Replace:", f.Query.Name)
+	f.unchecked.set(c)
+	f.c = c
+	c.RecordSuccess()
+	return nil
+}
+
+// describe returns the number of descriptors reported by c.
+func describe(c prometheus.Collector) int {
+	ch := make(chan *prometheus.Desc)
+	go func() {
+		c.Describe(ch)
+		close(ch)
+	}()
+	n := 0
+	for range ch {
+		n++
+	}
+	return n
 }
 
 // Update runs the collector query again.
-func (f *File) Update() error {
+func (f *File) Update(ctx context.Context) error {
 	if f.c != nil {
-		return f.c.Update()
+		return f.c.Update(ctx)
 	}
 	return nil
 }
@@ -1,11 +1,14 @@
 package setup
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"testing"
 	"time"
 
 	"github.com/m-lab/go/rtx"
+	"github.com/m-lab/prometheus-bigquery-exporter/internal/config"
 	"github.com/m-lab/prometheus-bigquery-exporter/sql"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/spf13/afero"
@@ -44,6 +47,18 @@ func TestFile_IsModified(t *testing.T) {
 			},
 			want: true,
 		},
+		{
+			name: "success-inline-query",
+			file: &File{},
+			want: true,
+		},
+		{
+			name: "success-inline-query-registered",
+			file: &File{
+				c: sql.NewCollector(&fakeRunner{}, prometheus.GaugeValue, "foo", ""),
+			},
+			want: false,
+		},
 		{
 			name: "error-missing-file",
 			file: &File{
@@ -69,7 +84,7 @@ func TestFile_IsModified(t *testing.T) {
 
 type fakeRunner struct{}
 
-func (f *fakeRunner) Query(query string) ([]sql.Metric, error) {
+func (f *fakeRunner) Query(ctx context.Context, query string) ([]sql.Metric, error) {
 	return nil, fmt.Errorf("Fake failure")
 }
 
@@ -95,7 +110,7 @@ func TestFile_Update(t *testing.T) {
 				Name: "example",
 				c:    tt.c,
 			}
-			if err := f.Update(); (err != nil) != tt.wantErr {
+			if err := f.Update(context.Background()); (err != nil) != tt.wantErr {
 				t.Errorf("File.Update() error = %v, wantErr %v", err, tt.wantErr)
 			}
 		})
@@ -106,43 +121,86 @@ type fakeRegister struct {
 	metric sql.Metric
 }
 
-func (f *fakeRegister) Query(query string) ([]sql.Metric, error) {
+func (f *fakeRegister) Query(ctx context.Context, query string) ([]sql.Metric, error) {
 	return []sql.Metric{f.metric}, nil
 }
 
+type emptyRunner struct{}
+
+func (f *emptyRunner) Query(ctx context.Context, query string) ([]sql.Metric, error) {
+	return nil, nil
+}
+
 func TestFile_Register(t *testing.T) {
+	fs = afero.NewMemMapFs()
+	fs.Create("example")
+	st, err := fs.Stat("example")
+	rtx.Must(err, "Failed to stat filesystem")
+
 	fr := &fakeRegister{
 		metric: sql.NewMetric([]string{}, []string{}, map[string]float64{"": 1.23}),
 	}
 	x := sql.NewCollector(fr, prometheus.GaugeValue, "foo", "")
+	// y uses the same metric name as x with different labels.
+	y := sql.NewCollector(&fakeRegister{
+		metric: sql.NewMetric([]string{"key"}, []string{"a"}, map[string]float64{"": 1.23}),
+	}, prometheus.GaugeValue, "foo", "")
 	tests := []struct {
 		name          string
 		fileCollector *sql.Collector
 		newCollector  *sql.Collector
-		wantErr       bool
+		wantErr       error
+		wantCollector *sql.Collector
+		wantReset     bool
 	}{
 		{
 			// Register should succeed.
-			name:         "register-success",
-			newCollector: x,
+			name:          "register-success",
+			newCollector:  x,
+			wantCollector: x,
 		},
 		{
 			// Try to register the same collector should return an error.
 			name:         "register-returns-error",
 			newCollector: x,
-			wantErr:      true,
+			wantErr:      ErrConflict,
 		},
 		{
 			// Unregister the same one registered above.
 			name:          "unregister-success",
 			fileCollector: x,
 			newCollector:  x,
+			wantCollector: x,
+		},
+		{
+			// Replacing x with a collector with conflicting labels should
+			// fail and keep x registered.
+			name:          "conflict-keeps-previous-collector",
+			fileCollector: x,
+			newCollector:  y,
+			wantErr:       ErrConflict,
+			wantCollector: x,
 		},
 		{
 			// Try to unregister a collector that was never registered.
 			name:          "unregister-returns-error",
 			fileCollector: sql.NewCollector(&fakeRunner{}, prometheus.GaugeValue, "foo", ""),
-			wantErr:       true,
+			newCollector:  sql.NewCollector(fr, prometheus.GaugeValue, "bar", ""),
+			wantErr:       ErrUnregister,
+		},
+		{
+			name:          "query-error-keeps-previous-collector",
+			fileCollector: x,
+			newCollector:  sql.NewCollector(&fakeRunner{}, prometheus.GaugeValue, "foo", ""),
+			wantErr:       ErrQuery,
+			wantCollector: x,
+			wantReset:     true,
+		},
+		{
+			name:         "empty-result",
+			newCollector: sql.NewCollector(&emptyRunner{}, prometheus.GaugeValue, "empty", ""),
+			wantErr:      ErrEmptyResult,
+			wantReset:    true,
 		},
 	}
 	for _, tt := range tests {
@@ -150,10 +208,60 @@ func TestFile_Register(t *testing.T) {
 			f := &File{
 				Name: "example",
 				c:    tt.fileCollector,
+				stat: st,
 			}
-			if err := f.Register(tt.newCollector); (err != nil) != tt.wantErr {
+			err := f.Register(context.Background(), tt.newCollector)
+			if !errors.Is(err, tt.wantErr) || (err == nil) != (tt.wantErr == nil) {
 				t.Errorf("File.Register() error = %v, wantErr %v", err, tt.wantErr)
 			}
+			if tt.wantCollector != nil && f.c != tt.wantCollector {
+				t.Errorf("File.Register() collector = %v, want %v", f.c, tt.wantCollector)
+			}
+			if (f.stat == nil) != tt.wantReset {
+				t.Errorf("File.Register() reset file state = %t, want %t", f.stat == nil, tt.wantReset)
+			}
 		})
 	}
+	// Verify that x is still registered.
+	if !prometheus.Unregister(x) {
+		t.Errorf("File.Register() did not keep the previous collector registered")
+	}
+}
+
+func TestFile_RegisterUnchecked(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	f := &File{
+		Query:      config.Query{Name: "foo"},
+		Registerer: reg,
+	}
+	newCollector := func(r sql.QueryRunner) *sql.Collector {
+		c := sql.NewCollector(r, prometheus.GaugeValue, "foo", "")
+		c.Unchecked = true
+		return c
+	}
+	x := newCollector(&fakeRegister{
+		metric: sql.NewMetric([]string{}, []string{}, map[string]float64{"": 1.23}),
+	})
+	if err := f.Register(context.Background(), x); err != nil {
+		t.Fatalf("File.Register() error = %v", err)
+	}
+	// Unchecked collectors may change labels without conflicts.
+	y := newCollector(&fakeRegister{
+		metric: sql.NewMetric([]string{"key"}, []string{"a"}, map[string]float64{"": 1.23}),
+	})
+	if err := f.Register(context.Background(), y); err != nil || f.c != y {
+		t.Fatalf("File.Register() error = %v, collector = %v, want %v", err, f.c, y)
+	}
+	// A failed query keeps the previous collector.
+	err := f.Register(context.Background(), newCollector(&fakeRunner{}))
+	if !errors.Is(err, ErrQuery) || f.c != y {
+		t.Errorf("File.Register() error = %v, collector = %v, want %v", err, f.c, y)
+	}
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("Gather() error = %v", err)
+	}
+	if len(mfs) != 1 || len(mfs[0].GetMetric()) != 1 || len(mfs[0].GetMetric()[0].GetLabel()) != 1 {
+		t.Errorf("Gather() = %v, want one metric with one label", mfs)
+	}
 }
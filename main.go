@@ -6,18 +6,26 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"os"
+	"os/signal"
 	"path/filepath"
 	"strings"
-	"sync"
+	"syscall"
 	"time"
 
 	"github.com/m-lab/go/flagx"
 	"github.com/m-lab/go/prometheusx"
 	"github.com/m-lab/go/rtx"
+	"github.com/m-lab/prometheus-bigquery-exporter/internal/clients"
+	"github.com/m-lab/prometheus-bigquery-exporter/internal/config"
+	"github.com/m-lab/prometheus-bigquery-exporter/internal/metrics"
+	"github.com/m-lab/prometheus-bigquery-exporter/internal/render"
+	"github.com/m-lab/prometheus-bigquery-exporter/internal/scheduler"
 	"github.com/m-lab/prometheus-bigquery-exporter/internal/setup"
 	"github.com/m-lab/prometheus-bigquery-exporter/query"
 	"github.com/m-lab/prometheus-bigquery-exporter/sql"
@@ -31,12 +39,19 @@ import (
 var (
 	counterSources = flagx.StringArray{}
 	gaugeSources   = flagx.StringArray{}
+	configFile     = flag.String("config", "", "Name of a YAML or JSON file describing queries.")
 	project        = flag.String("project", "", "GCP project name.")
-	refresh        = flag.Duration("refresh", 5*time.Minute, "Interval between updating metrics.")
+	refresh        = flag.Duration("refresh", 5*time.Minute, "Default interval between updating query metrics.")
+	timeout        = flag.Duration("timeout", 0, "Default maximum time to run a query. If zero, the refresh interval of the query is used.")
+	maxBytesBilled = flag.Int64("max-bytes-billed", 0, "Default maximum bytes billed for every query run. If zero, there is no limit.")
+	unchecked      = flag.Bool("unchecked", false, "Register query collectors as unchecked collectors, so query labels may change between refreshes.")
 )
 
+// registry holds the query collectors, separately from the metrics of the
+// exporter itself.
+var registry = prometheus.NewRegistry()
+
 func init() {
-	// TODO: support counter queries.
 	flag.Var(&counterSources, "counter-query", "Name of file containing a counter query.")
 	flag.Var(&gaugeSources, "gauge-query", "Name of file containing a gauge query.")
 
@@ -45,114 +60,360 @@ func init() {
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
 }
 
-// sleepUntilNext finds the nearest future time that is a multiple of the given
-// duration and sleeps until that time.
-func sleepUntilNext(d time.Duration) {
-	next := time.Now().Truncate(d).Add(d)
-	time.Sleep(time.Until(next))
-}
-
 // fileToMetric extracts the base file name to use as a prometheus metric name.
 func fileToMetric(filename string) string {
 	fname := filepath.Base(filename)
 	return strings.TrimSuffix(fname, filepath.Ext(fname))
 }
 
-// fileToQuery reads the content of the given file and returns the query with template values repalced with those in vars.
-func fileToQuery(filename string, vars map[string]string) string {
-	queryBytes, err := ioutil.ReadFile(filename)
-	rtx.Must(err, "Failed to open %q", filename)
-
-	q := string(queryBytes)
-	q = strings.Replace(q, "UNIX_START_TIME", vars["UNIX_START_TIME"], -1)
-	q = strings.Replace(q, "REFRESH_RATE_SEC", vars["REFRESH_RATE_SEC"], -1)
-	return q
-}
-
-func reloadRegisterUpdate(client *bigquery.Client, GaugeFiles []setup.File, CounterFiles []setup.File, vars map[string]string) {
-	var wg sync.WaitGroup
-	for i := range GaugeFiles {
-		wg.Add(1)
-		go func(f *setup.File) {
-			modified, err := f.IsModified()
-			if modified && err == nil {
-				c := sql.NewCollector(
-					newRunner(client), prometheus.GaugeValue,
-					fileToMetric(f.Name), fileToQuery(f.Name, vars))
-
-				log.Println("Registering:", fileToMetric(f.Name))
-				// NOTE: prometheus collector registration will fail when a file
-				// uses the same name but changes the metrics reported. Because
-				// this cannot be recovered, we use rtx.Must to exit and allow
-				// the runtime environment to restart.
-				rtx.Must(f.Register(c), "Failed to register collector: aborting")
-			} else {
-				start := time.Now()
-				err = f.Update()
-				log.Println("Updating:", fileToMetric(f.Name), time.Since(start))
-			}
-			if err != nil {
-				log.Println("Error:", f.Name, err)
-			}
-			wg.Done()
-		}(&GaugeFiles[i])
-	}
-	wg.Wait()
-	for i := range CounterFiles {
-		wg.Add(1)
-		go func(f *setup.File) {
-			modified, err := f.IsModified()
-			if modified && err == nil {
-				c := sql.NewCollector(
-					newRunner(client), prometheus.CounterValue,
-					fileToMetric(f.Name), fileToQuery(f.Name, vars))
-
-				log.Println("Registering:", fileToMetric(f.Name))
-				err = f.Register(c)
-			} else {
-				log.Println("Updating:", fileToMetric(f.Name))
-				err = f.Update()
-			}
-			if err != nil {
-				log.Println("Error:", f.Name, err)
-			}
-			wg.Done()
-		}(&CounterFiles[i])
-	}
-	wg.Wait()
+// queryText reads the query from the file or inline SQL of q.
+func queryText(q config.Query) (string, error) {
+	if q.File == "" {
+		return q.SQL, nil
+	}
+	queryBytes, err := ioutil.ReadFile(q.File)
+	if err != nil {
+		return "", err
+	}
+	return string(queryBytes), nil
 }
 
-var mainCtx, mainCancel = context.WithCancel(context.Background())
-var newRunner = func(client *bigquery.Client) sql.QueryRunner {
-	return query.NewBQRunner(client)
+// legacyTokens were replaced in the query text by earlier versions of the
+// exporter, and are now passed as named query parameters.
+var legacyTokens = []struct{ token, parameter string }{
+	{token: "UNIX_START_TIME", parameter: "UNIX_SECONDS(@" + config.StartTimeParameter + ")"},
+	{token: "REFRESH_RATE_SEC", parameter: "@" + config.RefreshRateParameter},
 }
 
-func main() {
-	flag.Parse()
-	rtx.Must(flagx.ArgsFromEnv(flag.CommandLine), "Could not get args from env")
+// warnLegacyTokens logs a warning for every legacy token in the query text,
+// since legacy tokens are no longer replaced, and returns the number found.
+func warnLegacyTokens(name, text string) int {
+	n := 0
+	for _, t := range legacyTokens {
+		if strings.Contains(text, t.token) {
+			log.Printf("Warning: query %q uses %s, which is no longer replaced; use %s instead",
+				name, t.token, t.parameter)
+			n++
+		}
+	}
+	return n
+}
 
-	srv := prometheusx.MustServeMetrics()
-	defer srv.Shutdown(mainCtx)
+// queryParameters returns the named query parameters for q, or an error if a
+// parameter from the configuration is invalid.
+func queryParameters(q config.Query) ([]bigquery.QueryParameter, error) {
+	params := []bigquery.QueryParameter{
+		{Name: config.StartTimeParameter, Value: startTime},
+		{Name: config.RefreshRateParameter, Value: int64(q.Refresh.Seconds())},
+	}
+	for _, p := range q.Parameters {
+		v, err := p.Parse()
+		if err != nil {
+			return nil, fmt.Errorf("invalid parameter %q: %w", p.Name, err)
+		}
+		params = append(params, bigquery.QueryParameter{Name: p.Name, Value: v})
+	}
+	return params, nil
+}
+
+// valueType returns the prometheus value type for the given query type.
+func valueType(t string) prometheus.ValueType {
+	switch t {
+	case config.Counter:
+		return prometheus.CounterValue
+	case config.Histogram, config.Summary:
+		// Histogram and summary metrics do not use a value type.
+		return prometheus.UntypedValue
+	default:
+		return prometheus.GaugeValue
+	}
+}
+
+// counterPolicy returns the sql.CounterPolicy for the given configured policy.
+func counterPolicy(p string) sql.CounterPolicy {
+	switch p {
+	case config.CounterDelta:
+		return sql.CounterDelta
+	case config.CounterMax:
+		return sql.CounterMax
+	default:
+		return sql.CounterTotal
+	}
+}
+
+// duplicatePolicy returns the sql.DuplicatePolicy for the given configured
+// policy.
+func duplicatePolicy(p string) sql.DuplicatePolicy {
+	switch p {
+	case config.DuplicateFirst:
+		return sql.DuplicateFirst
+	case config.DuplicateLast:
+		return sql.DuplicateLast
+	case config.DuplicateSum:
+		return sql.DuplicateSum
+	case config.DuplicateMax:
+		return sql.DuplicateMax
+	default:
+		return sql.DuplicateError
+	}
+}
 
-	GaugeFiles := make([]setup.File, len(gaugeSources))
-	for i := range GaugeFiles {
-		GaugeFiles[i].Name = gaugeSources[i]
+// templateContext returns the context for rendering the query template of q.
+// The time fields are set for every run of the query.
+func templateContext(q config.Query) render.Context {
+	return render.Context{
+		StartTime: startTime,
+		Refresh:   q.Refresh,
+		Env:       render.Environ(),
+		Vars:      q.Vars,
 	}
+}
 
-	CounterFiles := make([]setup.File, len(counterSources))
-	for i := range CounterFiles {
-		CounterFiles[i].Name = counterSources[i]
+// newCollector creates a collector for the current version of the query in f.
+func newCollector(pool *clients.Pool, f *setup.File) (*sql.Collector, error) {
+	text, err := queryText(f.Query)
+	if err != nil {
+		return nil, err
+	}
+	warnLegacyTokens(f.Query.Name, text)
+	// The query is rendered again for every run. Rendering it now reports
+	// template errors when loading the query, and allows headers to use
+	// template variables.
+	rendered, err := render.Query(f.Query.Name, text, templateContext(f.Query).At(time.Now()))
+	if err != nil {
+		return nil, err
+	}
+	// Settings from the query header apply to this version of the file only.
+	q := f.Query
+	q.ParseHeader(rendered)
+	err = q.Validate()
+	if err != nil {
+		return nil, err
+	}
+	r, err := newRunner(pool, q)
+	if err != nil {
+		return nil, err
 	}
+	c := sql.NewCollector(r, valueType(q.Type), q.Name, text)
+	c.Help = q.HelpText("")
+	c.ValueHelp = map[string]string{}
+	for column := range q.Values {
+		c.ValueHelp[q.ValueSuffix(column)] = q.HelpText(column)
+	}
+	c.ConstLabels = q.Labels
+	c.CounterPolicy = counterPolicy(q.CounterPolicy)
+	c.DuplicatePolicy = duplicatePolicy(q.Duplicates)
+	c.Unchecked = *unchecked
+	return c, nil
+}
 
-	client, err := bigquery.NewClient(mainCtx, *project)
-	rtx.Must(err, "Failed to allocate a new bigquery.Client")
-	vars := map[string]string{
-		"UNIX_START_TIME":  fmt.Sprintf("%d", time.Now().UTC().Unix()),
-		"REFRESH_RATE_SEC": fmt.Sprintf("%d", int(refresh.Seconds())),
+// jobLabels returns the labels of the query jobs for q, which identify the
+// exporter and the query, for billing attribution.
+func jobLabels(q config.Query) map[string]string {
+	labels := map[string]string{
+		"exporter": "bqx",
+		"query":    jobLabelValue(q.Name),
 	}
+	for k, v := range q.JobLabels {
+		labels[k] = v
+	}
+	return labels
+}
+
+// jobLabelValue converts s into a valid job label value, which may only
+// contain up to 63 lowercase letters, digits, '_' and '-'.
+func jobLabelValue(s string) string {
+	v := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '_', r == '-':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r - 'A' + 'a'
+		default:
+			return '_'
+		}
+	}, s)
+	if len(v) > 63 {
+		v = v[:63]
+	}
+	return v
+}
+
+// registerErrorReason returns the reason label for a failure to load or
+// register a query.
+func registerErrorReason(err error) string {
+	switch {
+	case errors.Is(err, setup.ErrQuery):
+		return "query"
+	case errors.Is(err, setup.ErrEmptyResult):
+		return "empty"
+	case errors.Is(err, setup.ErrUnregister):
+		return "unregister"
+	case errors.Is(err, setup.ErrConflict):
+		return "conflict"
+	default:
+		return "load"
+	}
+}
+
+// reloadRegisterUpdate registers a new collector for f when the query file is
+// modified, and otherwise updates the collector already registered. When a new
+// collector cannot be created or registered, the previous collector continues
+// to be served and updated. Registration is attempted again on the next run,
+// unless it cannot succeed before the file changes; see setup.File.Register.
+func reloadRegisterUpdate(ctx context.Context, pool *clients.Pool, f *setup.File) {
+	modified, err := f.IsModified()
+	if modified && err == nil {
+		var c *sql.Collector
+		c, err = newCollector(pool, f)
+		if err == nil {
+			log.Println("Registering:", f.Query.Name)
+			err = f.Register(ctx, c)
+		} else {
+			// Load the file again on the next run.
+			f.Reset()
+		}
+		if err == nil {
+			return
+		}
+		metrics.RegisterErrors.WithLabelValues(f.Query.Name, registerErrorReason(err)).Inc()
+		log.Println("Error:", f.Query.Name, err)
+		// Keep the previous collector, if any, up to date until the new
+		// collector registers successfully.
+	}
+	start := time.Now()
+	err = f.Update(ctx)
+	log.Println("Updating:", f.Query.Name, time.Since(start))
+	if err != nil {
+		log.Println("Error:", f.Query.Name, err)
+	}
+}
+
+// loadConfig reads the -config file, if any, and adds the queries named by the
+// -gauge-query and -counter-query flags.
+func loadConfig() *config.Config {
+	cfg := &config.Config{}
+	if *configFile != "" {
+		var err error
+		cfg, err = config.Load(*configFile)
+		rtx.Must(err, "Failed to load config %q", *configFile)
+	}
+	for _, name := range gaugeSources {
+		cfg.Queries = append(cfg.Queries, config.Query{
+			Name: fileToMetric(name), Type: config.Gauge, File: name})
+	}
+	for _, name := range counterSources {
+		cfg.Queries = append(cfg.Queries, config.Query{
+			Name: fileToMetric(name), Type: config.Counter, File: name})
+	}
+	for i := range cfg.Queries {
+		if cfg.Queries[i].Project == "" {
+			cfg.Queries[i].Project = *project
+		}
+		if cfg.Queries[i].Refresh == 0 {
+			cfg.Queries[i].Refresh = *refresh
+		}
+		if cfg.Queries[i].Timeout == 0 {
+			cfg.Queries[i].Timeout = *timeout
+		}
+		if cfg.Queries[i].MaxBytesBilled == 0 {
+			cfg.Queries[i].MaxBytesBilled = *maxBytesBilled
+		}
+		if cfg.Queries[i].Timeout == 0 {
+			cfg.Queries[i].Timeout = cfg.Queries[i].Refresh
+		}
+	}
+	rtx.Must(cfg.Validate(), "Invalid query configuration")
+	return cfg
+}
+
+var mainCtx, mainCancel = context.WithCancel(context.Background())
+
+// newRunner creates a runner for q, using the client for the project and
+// credentials of q.
+var newRunner = func(pool *clients.Pool, q config.Query) (sql.QueryRunner, error) {
+	params, err := queryParameters(q)
+	if err != nil {
+		return nil, err
+	}
+	client, err := pool.Get(clients.Key{
+		Project:                   q.Project,
+		CredentialsFile:           q.Credentials,
+		ImpersonateServiceAccount: q.ImpersonateServiceAccount,
+	})
+	if err != nil {
+		return nil, err
+	}
+	r := query.NewBQRunner(client)
+	r.Name = q.Name
+	r.Histogram = q.Type == config.Histogram
+	r.Summary = q.Type == config.Summary
+	r.Quantiles = q.Quantiles
+	r.Timeout = q.Timeout
+	r.MaxBytesBilled = q.MaxBytesBilled
+	r.Location = q.Location
+	r.Priority = bigquery.QueryPriority(q.Priority)
+	r.DisableQueryCache = q.DisableQueryCache
+	if q.Columns != nil {
+		r.LabelColumns = q.Columns.Labels
+		r.ValueColumns = q.Columns.Values
+	}
+	r.SkipNullLabels = q.NullLabels == config.NullSkip
+	r.SkipNullValues = q.NullValues == config.NullSkip
+	if q.NullValues == config.NullDefault {
+		r.NullValue = &q.NullDefault
+	}
+	r.Labels = jobLabels(q)
+	r.JobIDPrefix = q.JobIDPrefix
+	r.Parameters = params
+	ctx := templateContext(q)
+	r.Context = &ctx
+	return r, nil
+}
+
+// startTime is the value of the start_time parameter and StartTime template
+// variable of every query.
+var startTime = time.Now().UTC()
+
+func main() {
+	flag.Parse()
+	rtx.Must(flagx.ArgsFromEnv(flag.CommandLine), "Could not get args from env")
+
+	// Serve the query metrics together with the exporter metrics.
+	prometheus.DefaultGatherer = prometheus.Gatherers{prometheus.DefaultGatherer, registry}
+	srv := prometheusx.MustServeMetrics()
+	// mainCtx is done before shutdown, so allow current scrapes to complete.
+	defer srv.Shutdown(context.Background())
 
-	for mainCtx.Err() == nil {
-		reloadRegisterUpdate(client, GaugeFiles, CounterFiles, vars)
-		sleepUntilNext(*refresh)
+	cfg := loadConfig()
+	files := make([]setup.File, len(cfg.Queries))
+	// Clients are created on first use, and shared by queries billed to the
+	// same project.
+	pool := clients.NewPool(mainCtx)
+	defer pool.Close()
+	s := scheduler.New()
+	for i, q := range cfg.Queries {
+		files[i].Name = q.File
+		files[i].Query = q
+		files[i].Registerer = registry
+		// Each query runs on its own interval so that slow queries do not
+		// delay others.
+		f := &files[i]
+		s.Add(q.Refresh, func(ctx context.Context) {
+			reloadRegisterUpdate(ctx, pool, f)
+		})
 	}
+	// Cancel running queries and stop on SIGTERM or SIGINT.
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM, os.Interrupt)
+	defer signal.Stop(sig)
+	go func() {
+		select {
+		case <-sig:
+			log.Println("Shutting down")
+			mainCancel()
+		case <-mainCtx.Done():
+		}
+	}()
+	s.Run(mainCtx)
 }
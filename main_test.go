@@ -11,12 +11,21 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"reflect"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"cloud.google.com/go/bigquery"
 	"github.com/m-lab/go/rtx"
+	"github.com/m-lab/prometheus-bigquery-exporter/internal/clients"
+	"github.com/m-lab/prometheus-bigquery-exporter/internal/config"
+	"github.com/m-lab/prometheus-bigquery-exporter/internal/metrics"
+	"github.com/m-lab/prometheus-bigquery-exporter/internal/setup"
 	"github.com/m-lab/prometheus-bigquery-exporter/sql"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 func init() {
@@ -25,9 +34,10 @@ func init() {
 
 type fakeRunner struct {
 	updated int
+	total   *int32
 }
 
-func (f *fakeRunner) Query(query string) ([]sql.Metric, error) {
+func (f *fakeRunner) Query(ctx context.Context, query string) ([]sql.Metric, error) {
 	r := []sql.Metric{
 		{
 			LabelKeys:   []string{"key"},
@@ -38,6 +48,7 @@ func (f *fakeRunner) Query(query string) ([]sql.Metric, error) {
 		},
 	}
 	f.updated++
+	atomic.AddInt32(f.total, 1)
 	if f.updated > 1 {
 		// Simulate an error after one successful query.
 		return nil, fmt.Errorf("Fake failure for testing")
@@ -46,23 +57,28 @@ func (f *fakeRunner) Query(query string) ([]sql.Metric, error) {
 }
 
 func Test_main(t *testing.T) {
-	tmp, err := ioutil.TempFile("", "empty_query_*")
+	gauge, err := ioutil.TempFile("", "empty_gauge_query_*")
 	rtx.Must(err, "Failed to create temp file for main test.")
-	defer os.Remove(tmp.Name())
+	defer os.Remove(gauge.Name())
+	counter, err := ioutil.TempFile("", "empty_counter_query_*")
+	rtx.Must(err, "Failed to create temp file for main test.")
+	defer os.Remove(counter.Name())
 
 	// Provide coverage of the original newRunner definition.
-	newRunner(nil)
+	newRunner(clients.NewPool(context.Background()), config.Query{Project: "mlab-testing"})
 
-	// Create a fake runner for the test.
-	f := &fakeRunner{}
-	newRunner = func(*bigquery.Client) sql.QueryRunner {
-		return f
+	// Create a fake runner for each query in the test.
+	orig := newRunner
+	defer func() { newRunner = orig }()
+	var total int32
+	newRunner = func(*clients.Pool, config.Query) (sql.QueryRunner, error) {
+		return &fakeRunner{total: &total}, nil
 	}
 
 	// Set the refresh period to a very small delay.
 	*refresh = time.Second
-	gaugeSources.Set(tmp.Name())
-	counterSources.Set(tmp.Name())
+	gaugeSources.Set(gauge.Name())
+	counterSources.Set(counter.Name())
 
 	// Reset mainCtx to timeout after a second.
 	mainCtx, mainCancel = context.WithTimeout(mainCtx, time.Second)
@@ -70,8 +86,204 @@ func Test_main(t *testing.T) {
 
 	main()
 
-	// Verify that the fakeRunner was called twice.
-	if f.updated != 4 {
-		t.Errorf("main() failed to update; got %d, want 4", f.updated)
+	// Verify that each fakeRunner was called twice.
+	if total != 4 {
+		t.Errorf("main() failed to update; got %d, want 4", total)
+	}
+}
+
+func Test_newCollector(t *testing.T) {
+	orig := newRunner
+	defer func() { newRunner = orig }()
+	newRunner = func(*clients.Pool, config.Query) (sql.QueryRunner, error) {
+		return &fakeRunner{}, nil
+	}
+	tests := []struct {
+		name    string
+		query   string
+		wantErr bool
+	}{
+		{
+			name:  "success",
+			query: "-- label_team: widgets\nSELECT 1 AS value",
+		},
+		{
+			name:  "success-template",
+			query: "-- label_team: {{.Vars.team}}\nSELECT 1 AS value",
+		},
+		{
+			name:    "error-template",
+			query:   "-- label_team: widgets\nSELECT {{.Vars.missing}} AS value",
+			wantErr: true,
+		},
+		{
+			name:    "error-invalid-header-label",
+			query:   "-- label___team: widgets\nSELECT 1 AS value",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &setup.File{
+				Query: config.Query{
+					Name: "widgets", Type: config.Gauge, SQL: tt.query, Project: "mlab-testing",
+					Vars: map[string]string{"team": "widgets"},
+				},
+			}
+			c, err := newCollector(clients.NewPool(context.Background()), f)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("newCollector() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !tt.wantErr && c.ConstLabels["team"] != "widgets" {
+				t.Errorf("newCollector() labels = %v, want team=widgets", c.ConstLabels)
+			}
+		})
+	}
+}
+
+func Test_warnLegacyTokens(t *testing.T) {
+	text := "SELECT COUNT(*) AS value FROM t WHERE time > TIMESTAMP_SECONDS(UNIX_START_TIME - REFRESH_RATE_SEC)"
+	if got := warnLegacyTokens("legacy", text); got != 2 {
+		t.Errorf("warnLegacyTokens() = %d, want 2", got)
+	}
+	if got := warnLegacyTokens("current", "SELECT @start_time AS value"); got != 0 {
+		t.Errorf("warnLegacyTokens() = %d, want 0", got)
+	}
+}
+
+func Test_queryParameters(t *testing.T) {
+	q := config.Query{
+		Refresh:    time.Minute,
+		Parameters: []config.Parameter{{Name: "min_count", Type: config.Int64, Value: "10"}},
+	}
+	want := []bigquery.QueryParameter{
+		{Name: "start_time", Value: startTime},
+		{Name: "refresh_rate_sec", Value: int64(60)},
+		{Name: "min_count", Value: int64(10)},
+	}
+	if got, err := queryParameters(q); err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("queryParameters() = %#v, %v; want %#v", got, err, want)
+	}
+	q.Parameters = []config.Parameter{{Name: "min_count", Type: config.Int64, Value: "ten"}}
+	if _, err := queryParameters(q); err == nil {
+		t.Errorf("queryParameters() expected error for invalid parameter")
+	}
+}
+
+func Test_jobLabels(t *testing.T) {
+	q := config.Query{
+		Name:      "bq_Widgets:total",
+		JobLabels: map[string]string{"team": "widgets", "exporter": "custom"},
+	}
+	want := map[string]string{"exporter": "custom", "query": "bq_widgets_total", "team": "widgets"}
+	if got := jobLabels(q); !reflect.DeepEqual(got, want) {
+		t.Errorf("jobLabels() = %v, want %v", got, want)
+	}
+	if got := jobLabelValue(strings.Repeat("a", 100)); len(got) != 63 {
+		t.Errorf("jobLabelValue() length = %d, want 63", len(got))
+	}
+}
+
+func Test_registerErrorReason(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{err: fmt.Errorf("%w: detail", setup.ErrQuery), want: "query"},
+		{err: fmt.Errorf("%w: detail", setup.ErrEmptyResult), want: "empty"},
+		{err: fmt.Errorf("%w: detail", setup.ErrUnregister), want: "unregister"},
+		{err: fmt.Errorf("%w: detail", setup.ErrConflict), want: "conflict"},
+		{err: os.ErrNotExist, want: "load"},
+	}
+	for _, tt := range tests {
+		if got := registerErrorReason(tt.err); got != tt.want {
+			t.Errorf("registerErrorReason(%v) = %q, want %q", tt.err, got, tt.want)
+		}
+	}
+}
+
+func Test_reloadRegisterUpdateLoadError(t *testing.T) {
+	f := &setup.File{
+		Query: config.Query{Name: "invalid_header", Type: config.Gauge, SQL: "-- label___bad: x"},
+	}
+	reloadRegisterUpdate(context.Background(), nil, f)
+	v := testutil.ToFloat64(metrics.RegisterErrors.WithLabelValues("invalid_header", "load"))
+	if v != 1 {
+		t.Errorf("reloadRegisterUpdate() register errors = %v, want 1", v)
+	}
+}
+
+// conflictRegisterer fails to register any collector but the first.
+type conflictRegisterer struct {
+	prometheus.Registerer
+	first prometheus.Collector
+}
+
+func (r *conflictRegisterer) Register(c prometheus.Collector) error {
+	if r.first != nil && r.first != c {
+		return fmt.Errorf("Fake conflict for testing")
+	}
+	r.first = c
+	return r.Registerer.Register(c)
+}
+
+func Test_reloadRegisterUpdateConflict(t *testing.T) {
+	tmp, err := ioutil.TempFile("", "reload_conflict_*")
+	rtx.Must(err, "Failed to create temp file")
+	defer os.Remove(tmp.Name())
+
+	orig := newRunner
+	defer func() { newRunner = orig }()
+	var total int32
+	var runners []*fakeRunner
+	newRunner = func(*clients.Pool, config.Query) (sql.QueryRunner, error) {
+		r := &fakeRunner{total: &total}
+		runners = append(runners, r)
+		return r, nil
+	}
+
+	f := &setup.File{
+		Name:       tmp.Name(),
+		Query:      config.Query{Name: "reload_conflict", Type: config.Gauge, File: tmp.Name()},
+		Registerer: &conflictRegisterer{Registerer: prometheus.NewRegistry()},
+	}
+	ctx := context.Background()
+	reloadRegisterUpdate(ctx, nil, f)
+	if len(runners) != 1 || runners[0].updated != 1 {
+		t.Fatalf("reloadRegisterUpdate() failed to register first collector")
+	}
+	// The first collector succeeds once, so the last success time must not
+	// change while registration of new collectors keeps failing.
+	metrics.QueryLastSuccess.WithLabelValues("reload_conflict").Set(0)
+	// Modify the file to load a new collector.
+	later := time.Now().Add(time.Minute)
+	rtx.Must(os.Chtimes(tmp.Name(), later, later), "Failed to modify temp file")
+	for i := 0; i < 2; i++ {
+		// A conflict cannot be resolved without changing the file, so the
+		// file is not loaded again until it is modified.
+		reloadRegisterUpdate(ctx, nil, f)
+	}
+	if len(runners) != 2 {
+		t.Fatalf("reloadRegisterUpdate() created %d collectors, want 2", len(runners))
+	}
+	if runners[0].updated != 3 {
+		t.Errorf("reloadRegisterUpdate() updated registered collector %d times, want 3", runners[0].updated)
+	}
+	v := testutil.ToFloat64(metrics.RegisterErrors.WithLabelValues("reload_conflict", "conflict"))
+	if v != 1 {
+		t.Errorf("reloadRegisterUpdate() register errors = %v, want 1", v)
+	}
+	// Modify the file again to load another collector.
+	later = later.Add(time.Minute)
+	rtx.Must(os.Chtimes(tmp.Name(), later, later), "Failed to modify temp file")
+	reloadRegisterUpdate(ctx, nil, f)
+	if len(runners) != 3 || runners[0].updated != 4 {
+		t.Errorf("reloadRegisterUpdate() created %d collectors and updated registered collector %d times, want 3 and 4",
+			len(runners), runners[0].updated)
+	}
+	v = testutil.ToFloat64(metrics.QueryLastSuccess.WithLabelValues("reload_conflict"))
+	if v != 0 {
+		t.Errorf("reloadRegisterUpdate() last success = %v, want 0", v)
 	}
 }
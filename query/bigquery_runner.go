@@ -5,12 +5,24 @@ package query
 
 import (
 	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
 	"math"
+	"math/big"
 	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/civil"
 	"github.com/googleapis/google-cloud-go-testing/bigquery/bqiface"
+	"github.com/m-lab/go/logx"
+	"github.com/m-lab/prometheus-bigquery-exporter/internal/config"
+	"github.com/m-lab/prometheus-bigquery-exporter/internal/metrics"
+	"github.com/m-lab/prometheus-bigquery-exporter/internal/render"
 	"github.com/m-lab/prometheus-bigquery-exporter/sql"
 	"google.golang.org/api/iterator"
 )
@@ -19,35 +31,184 @@ type bigQueryImpl struct {
 	bqiface.Client
 }
 
-func (b *bigQueryImpl) Query(query string, visit func(row map[string]bigquery.Value) error) error {
-	q := b.Client.Query(query)
-	it, err := q.Read(context.Background())
+// cancelTimeout is the time allowed to request cancellation of a job.
+const cancelTimeout = 10 * time.Second
+
+// cancelJob requests cancellation of the job. Cancellation is not guaranteed,
+// and the job may still complete.
+func cancelJob(job bqiface.Job) {
+	ctx, cancel := context.WithTimeout(context.Background(), cancelTimeout)
+	defer cancel()
+	err := job.Cancel(ctx)
+	log.Println("Cancel job:", job.ID(), err)
+}
+
+// queryResult holds the details of a completed query job.
+type queryResult struct {
+	// schema describes the result columns. The schema is available even when
+	// the query returns no rows.
+	schema bigquery.Schema
+	// stats are the job statistics, or nil if they are not available.
+	stats *bigquery.JobStatistics
+}
+
+// jobConfig holds the configuration of a query job.
+type jobConfig struct {
+	query bigquery.QueryConfig
+	id    bigquery.JobIDConfig
+}
+
+func (b *bigQueryImpl) query(cfg jobConfig) bqiface.Query {
+	q := b.Client.Query(cfg.query.Q)
+	q.SetQueryConfig(bqiface.QueryConfig{QueryConfig: cfg.query})
+	*q.JobIDConfig() = cfg.id
+	return q
+}
+
+func (b *bigQueryImpl) DryRun(ctx context.Context, cfg jobConfig) (*bigquery.JobStatistics, error) {
+	cfg.query.DryRun = true
+	job, err := b.query(cfg).Run(ctx)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	// Dry run jobs are not created, so the statistics are only available
+	// from the status returned by Run.
+	status := job.LastStatus()
+	if status == nil {
+		return nil, nil
+	}
+	return status.Statistics, nil
+}
+
+func (b *bigQueryImpl) Query(ctx context.Context, cfg jobConfig, visit func(row map[string]bigquery.Value) error) (*queryResult, error) {
+	job, err := b.query(cfg).Run(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// If the context is done before all results are read, e.g. because the
+	// query timed out, cancel the job so that it does not continue to run.
+	defer func() {
+		if ctx.Err() != nil {
+			cancelJob(job)
+		}
+	}()
+	it, err := job.Read(ctx)
+	if err != nil {
+		return nil, err
 	}
 	var row map[string]bigquery.Value
 	for err = it.Next(&row); err == nil; err = it.Next(&row) {
+		expandNulls(row, it.Schema())
 		err2 := visit(row)
 		if err2 != nil {
-			return err2
+			return nil, err2
 		}
 	}
 	if err != iterator.Done {
-		return err
+		return nil, err
 	}
-	return nil
+	// The schema is set once the iterator has fetched the first page.
+	result := &queryResult{schema: it.Schema()}
+	// Statistics are only complete once the job is done, so get the status
+	// after reading all results. Missing statistics are not a query error.
+	status, err := job.Status(ctx)
+	if err != nil {
+		log.Println("Failed to get job status:", job.ID(), err)
+		return result, nil
+	}
+	result.stats = status.Statistics
+	return result, nil
 }
 
 // BQRunner is a concerete implementation of QueryRunner for BigQuery.
 type BQRunner struct {
 	runner runner
+
+	// Name identifies the query in the metrics recorded for every job.
+	Name string
+
+	// Histogram enables conversion of query results into histograms instead
+	// of values. See rowToHistogram for the expected result columns.
+	Histogram bool
+	// Summary enables conversion of query results into summaries instead of
+	// values. See rowToSummary for the expected result columns.
+	Summary bool
+	// Quantiles are the quantiles reported by summaries. If empty,
+	// DefaultQuantiles are used.
+	Quantiles []float64
+	// Parameters are the named query parameters for every run. The "now"
+	// TIMESTAMP parameter is added to every run, with the current time.
+	Parameters []bigquery.QueryParameter
+	// Timeout is the maximum time to run the query and read all results. If
+	// zero, queries run until the context of Query is done.
+	Timeout time.Duration
+	// MaxBytesBilled limits the bytes billed for every job. Before the first
+	// run, the bytes processed are estimated with a dry run, and the query is
+	// refused if the estimate is greater than MaxBytesBilled. If zero, there
+	// is no limit.
+	MaxBytesBilled int64
+	// Location is the processing location of query jobs, e.g. "US". If
+	// empty, BigQuery selects the location from the tables used.
+	Location string
+	// Priority is the priority of query jobs. If empty,
+	// bigquery.InteractivePriority is used.
+	Priority bigquery.QueryPriority
+	// DisableQueryCache prevents results being served from the query cache.
+	DisableQueryCache bool
+	// Labels are added to every query job, e.g. for billing attribution.
+	Labels map[string]string
+	// JobIDPrefix is the prefix of query job IDs, followed by a random
+	// suffix. If empty, BigQuery generates the job IDs.
+	JobIDPrefix string
+	// LabelColumns and ValueColumns declare the label and value columns of
+	// results, with ValueColumns mapping column names to metric suffixes. If
+	// ValueColumns is empty, columns named "value*" are values and all other
+	// columns are labels. Not supported by Histogram or Summary queries.
+	LabelColumns []string
+	ValueColumns map[string]string
+	// SkipNullLabels skips result rows with NULL label columns. Otherwise,
+	// NULL labels are empty.
+	SkipNullLabels bool
+	// SkipNullValues skips result rows with NULL value columns.
+	SkipNullValues bool
+	// NullValue, if not nil, replaces NULL value columns. Otherwise, NULL
+	// values are NaN. Ignored if SkipNullValues is true.
+	NullValue *float64
+	// Context is the query template context. If not nil, the query is
+	// rendered as a template before every run, with the time fields of the
+	// context set for the run. See render.Context.At.
+	Context *render.Context
+
+	// estimated is true once the query passed the dry run.
+	estimated bool
+
+	// schema describes the results of the last query.
+	schema *sql.Metric
+	// rows is the number of rows returned by the last query.
+	rows int
 }
 
-// runner interface allows unit testing of the Query function.
+// runner interface allows unit testing of the Query function. Query returns
+// the result schema and statistics of the query job. DryRun returns the
+// statistics of a dry run of the query, which are nil if unavailable.
 type runner interface {
-	Query(q string, visit func(row map[string]bigquery.Value) error) error
+	Query(ctx context.Context, cfg jobConfig, visit func(row map[string]bigquery.Value) error) (*queryResult, error)
+	DryRun(ctx context.Context, cfg jobConfig) (*bigquery.JobStatistics, error)
 }
 
+// ErrOverBudget is returned when the estimated bytes processed by a query are
+// greater than the maximum bytes billed.
+var ErrOverBudget = errors.New("estimated bytes exceed maximum bytes billed")
+
+// ErrBigNumeric is returned when the query results have a BIGNUMERIC column.
+// The BigQuery client cannot read BIGNUMERIC values, so queries must CAST
+// them to NUMERIC or FLOAT64.
+var ErrBigNumeric = errors.New("BIGNUMERIC columns are not supported")
+
+// bigNumericFieldType is the BIGNUMERIC field type, which is not known to the
+// BigQuery client.
+const bigNumericFieldType bigquery.FieldType = "BIGNUMERIC"
+
 // NewBQRunner creates a new QueryRunner instance.
 func NewBQRunner(client *bigquery.Client) *BQRunner {
 	return &BQRunner{
@@ -57,13 +218,24 @@ func NewBQRunner(client *bigquery.Client) *BQRunner {
 	}
 }
 
-// Query executes the given query. Query only supports standard SQL. The
-// query must define a column named "value" for the value, and may define
-// additional columns, all of which are used as metric labels.
-func (qr *BQRunner) Query(query string) ([]sql.Metric, error) {
+// Query executes the given query. Query only supports standard SQL. Unless
+// the columns are declared by ValueColumns, the query must define a column
+// named "value" for the value, and may define additional columns, all of
+// which are used as metric labels.
+func (qr *BQRunner) Query(ctx context.Context, query string) ([]sql.Metric, error) {
+	if qr.Histogram {
+		return qr.queryHistograms(ctx, query)
+	}
+	if qr.Summary {
+		return qr.querySummaries(ctx, query)
+	}
 	metrics := []sql.Metric{}
-	err := qr.runner.Query(query, func(row map[string]bigquery.Value) error {
-		metrics = append(metrics, rowToMetric(row))
+	err := qr.run(ctx, query, func(row map[string]bigquery.Value) error {
+		m, err := qr.convert(row)
+		if err != nil {
+			return err
+		}
+		metrics = append(metrics, m)
 		return nil
 	})
 	if err != nil {
@@ -72,32 +244,335 @@ func (qr *BQRunner) Query(query string) ([]sql.Metric, error) {
 	return metrics, nil
 }
 
+// Schema satisfies the sql.SchemaRunner interface. Schema returns a metric
+// with the labels and values of the last query results, derived from the
+// result schema, or nil if the schema is unknown.
+func (qr *BQRunner) Schema() *sql.Metric {
+	return qr.schema
+}
+
+// RowCount satisfies the sql.RowCountRunner interface. RowCount returns the
+// number of rows returned by the last successful query, before nested columns
+// are unnested or rows are skipped.
+func (qr *BQRunner) RowCount() int {
+	return qr.rows
+}
+
+// convert converts a result row into a sql.Metric for the type of query.
+func (qr *BQRunner) convert(row map[string]bigquery.Value) (sql.Metric, error) {
+	switch {
+	case qr.Histogram:
+		return rowToHistogram(row)
+	case qr.Summary:
+		return rowToSummary(row, qr.quantiles())
+	case len(qr.ValueColumns) > 0:
+		return rowToDeclaredMetric(row, qr.LabelColumns, qr.ValueColumns)
+	default:
+		return rowToMetric(row), nil
+	}
+}
+
+// setSchema converts the result schema into a metric using a placeholder row,
+// so that the labels and values match those of real result rows.
+func (qr *BQRunner) setSchema(schema bigquery.Schema) {
+	qr.schema = nil
+	if len(schema) == 0 {
+		return
+	}
+	rows, err := flattenRow(schemaToRow(schema))
+	if err != nil || len(rows) == 0 {
+		logx.Debug.Println("Failed to flatten schema:", qr.Name, err)
+		return
+	}
+	row, err := qr.sanitizeRow(rows[0])
+	if err != nil {
+		logx.Debug.Println("Failed to sanitize schema:", qr.Name, err)
+		return
+	}
+	m, err := qr.convert(row)
+	if err != nil {
+		logx.Debug.Println("Failed to convert schema:", qr.Name, err)
+		return
+	}
+	qr.schema = &m
+}
+
+// schemaToRow creates a placeholder row with a zero value for every column in
+// the schema. REPEATED RECORD columns hold a single placeholder record.
+func schemaToRow(schema bigquery.Schema) map[string]bigquery.Value {
+	row := make(map[string]bigquery.Value, len(schema))
+	for _, f := range schema {
+		switch {
+		case f.Schema != nil && f.Repeated:
+			row[f.Name] = []bigquery.Value{schemaToRow(f.Schema)}
+		case f.Schema != nil:
+			row[f.Name] = schemaToRow(f.Schema)
+		case f.Repeated:
+			row[f.Name] = []bigquery.Value{}
+		case f.Type == bigquery.IntegerFieldType:
+			row[f.Name] = int64(0)
+		case f.Type == bigquery.FloatFieldType:
+			row[f.Name] = float64(0)
+		case f.Type == bigquery.StringFieldType:
+			row[f.Name] = "0"
+		default:
+			row[f.Name] = nil
+		}
+	}
+	return row
+}
+
+// run renders the query, runs it with the runner, and records the result
+// schema and job statistics.
+func (qr *BQRunner) run(ctx context.Context, query string, visit func(row map[string]bigquery.Value) error) error {
+	if qr.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, qr.Timeout)
+		defer cancel()
+	}
+	now := time.Now().UTC()
+	if qr.Context != nil {
+		var err error
+		query, err = render.Query(qr.Name, query, qr.Context.At(now))
+		if err != nil {
+			return err
+		}
+	}
+	cfg := qr.jobConfig(query, now)
+	if !qr.estimated {
+		err := qr.estimate(ctx, cfg)
+		if err != nil {
+			return err
+		}
+		qr.estimated = true
+	}
+	if qr.SkipNullLabels || qr.SkipNullValues || qr.NullValue != nil {
+		visit = qr.handleNulls(visit)
+	}
+	visit = flatten(qr.sanitize(visit))
+	rows := 0
+	result, err := qr.runner.Query(ctx, cfg, func(row map[string]bigquery.Value) error {
+		rows++
+		return visit(row)
+	})
+	if err != nil {
+		return err
+	}
+	qr.rows = rows
+	qr.setSchema(result.schema)
+	stats := result.stats
+	if stats == nil {
+		return nil
+	}
+	metrics.QueryBytesProcessed.WithLabelValues(qr.Name).Add(float64(stats.TotalBytesProcessed))
+	if details, ok := stats.Details.(*bigquery.QueryStatistics); ok {
+		metrics.QueryBytesBilled.WithLabelValues(qr.Name).Add(float64(details.TotalBytesBilled))
+		cacheHit := 0.0
+		if details.CacheHit {
+			cacheHit = 1
+		}
+		metrics.QueryCacheHit.WithLabelValues(qr.Name).Set(cacheHit)
+	}
+	return nil
+}
+
+// isLabel returns true if column k holds a label for the type of query.
+func (qr *BQRunner) isLabel(k string) bool {
+	if len(qr.ValueColumns) > 0 {
+		return contains(qr.LabelColumns, k)
+	}
+	if strings.HasPrefix(k, "value") {
+		return false
+	}
+	return !qr.Histogram || (k != leColumn && !strings.HasPrefix(k, bucketPrefix))
+}
+
+// handleNulls returns a visit function that applies the NULL policies of the
+// runner to every row before passing it to visit. Skipped rows are counted by
+// the reason they were skipped.
+func (qr *BQRunner) handleNulls(visit func(row map[string]bigquery.Value) error) func(row map[string]bigquery.Value) error {
+	return func(row map[string]bigquery.Value) error {
+		var nullLabels, nulls []string
+		for _, k := range sortedKeys(row) {
+			if row[k] != nil {
+				continue
+			}
+			if qr.isLabel(k) {
+				nullLabels = append(nullLabels, k)
+			} else {
+				nulls = append(nulls, k)
+			}
+		}
+		// NULL labels are checked first, so that rows with NULL labels and
+		// values are always counted with the same reason.
+		reason := ""
+		switch {
+		case qr.SkipNullLabels && len(nullLabels) > 0:
+			reason = "null_label"
+		case qr.SkipNullValues && len(nulls) > 0:
+			reason = "null_value"
+		}
+		if reason != "" {
+			logx.Debug.Println("Skipping row with NULL columns:", qr.Name, nullLabels, nulls)
+			metrics.RowsDropped.WithLabelValues(qr.Name, reason).Inc()
+			return nil
+		}
+		if qr.NullValue == nil {
+			nulls = nil
+		}
+		if len(nulls) > 0 {
+			r := make(map[string]bigquery.Value, len(row))
+			for k, v := range row {
+				r[k] = v
+			}
+			for _, k := range nulls {
+				r[k] = *qr.NullValue
+			}
+			row = r
+		}
+		return visit(row)
+	}
+}
+
+// jobConfig returns the configuration of a job for the query run at now.
+func (qr *BQRunner) jobConfig(query string, now time.Time) jobConfig {
+	cfg := jobConfig{
+		query: bigquery.QueryConfig{
+			Q: query,
+			Parameters: append([]bigquery.QueryParameter{
+				{Name: config.NowParameter, Value: now},
+			}, qr.Parameters...),
+			MaxBytesBilled:    qr.MaxBytesBilled,
+			Priority:          qr.Priority,
+			DisableQueryCache: qr.DisableQueryCache,
+			Labels:            qr.Labels,
+		},
+		id: bigquery.JobIDConfig{Location: qr.Location},
+	}
+	if qr.JobIDPrefix != "" {
+		cfg.id.JobID = qr.JobIDPrefix
+		cfg.id.AddJobIDSuffix = true
+	}
+	return cfg
+}
+
+// estimate records the bytes processed by the query, estimated by a dry run,
+// and returns ErrOverBudget if the estimate is greater than MaxBytesBilled.
+// estimate returns ErrBigNumeric if the dry run schema has a BIGNUMERIC
+// column.
+func (qr *BQRunner) estimate(ctx context.Context, cfg jobConfig) error {
+	stats, err := qr.runner.DryRun(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	if stats == nil {
+		return nil
+	}
+	if details, ok := stats.Details.(*bigquery.QueryStatistics); ok {
+		if name := bigNumericColumn(details.Schema); name != "" {
+			return fmt.Errorf("%w: %s: %q", ErrBigNumeric, qr.Name, name)
+		}
+	}
+	metrics.QueryEstimatedBytes.WithLabelValues(qr.Name).Set(float64(stats.TotalBytesProcessed))
+	if qr.MaxBytesBilled > 0 && stats.TotalBytesProcessed > qr.MaxBytesBilled {
+		metrics.QueryOverBudget.WithLabelValues(qr.Name).Inc()
+		return fmt.Errorf("%w: %s: %d > %d", ErrOverBudget, qr.Name, stats.TotalBytesProcessed, qr.MaxBytesBilled)
+	}
+	return nil
+}
+
+// bigNumericColumn returns the name of the first BIGNUMERIC column in schema,
+// including the fields of STRUCT columns, or "" if there is none.
+func bigNumericColumn(schema bigquery.Schema) string {
+	for _, f := range schema {
+		if f.Type == bigNumericFieldType {
+			return f.Name
+		}
+		if name := bigNumericColumn(f.Schema); name != "" {
+			return f.Name + "." + name
+		}
+	}
+	return ""
+}
+
 // valToFloat extracts a float from the bigquery.Value irrespective of the
-// underlying type. If the type is not int64, float64, then valToFloat returns
-// zero.
+// underlying type. BOOL values are 0 or 1, NUMERIC values are rounded to the
+// nearest float, and TIMESTAMP, DATE and DATETIME values are seconds since the
+// unix epoch, in UTC for civil times. TIME values are seconds since midnight.
+// For NULL and all other types, valToFloat returns NaN.
 func valToFloat(v bigquery.Value) float64 {
-	switch v.(type) {
+	switch t := v.(type) {
 	case int64:
-		return (float64)(v.(int64))
+		return float64(t)
 	case float64:
-		return v.(float64)
+		return t
+	case bool:
+		if t {
+			return 1
+		}
+		return 0
+	case *big.Rat:
+		f, _ := t.Float64()
+		return f
+	case time.Time:
+		return timeToFloat(t)
+	case civil.Date:
+		return timeToFloat(t.In(time.UTC))
+	case civil.DateTime:
+		return timeToFloat(t.In(time.UTC))
+	case civil.Time:
+		return float64(t.Hour*3600+t.Minute*60+t.Second) + float64(t.Nanosecond)/1e9
 	default:
 		return math.NaN()
 	}
 }
 
-// valToString coerces the bigquery.Value into a string. If the underlying type
-// is not a string, we treat it like an int64 or float64. If the underlying is
-// none of these types, valToString returns "invalid string".
+// timeToFloat converts t into seconds since the unix epoch.
+func timeToFloat(t time.Time) float64 {
+	return float64(t.Unix()) + float64(t.Nanosecond())/1e9
+}
+
+// valToString coerces the bigquery.Value into a label value. Numbers and BOOL
+// values are formatted in their shortest form, TIMESTAMP values as RFC3339 in
+// UTC, civil times in their BigQuery SQL form, and BYTES as base64.
+// NULL values are empty.
 func valToString(v bigquery.Value) string {
-	var s string
-	switch v.(type) {
+	switch t := v.(type) {
+	case nil:
+		return ""
 	case string:
-		s = v.(string)
+		return t
+	case int64:
+		return strconv.FormatInt(t, 10)
+	case float64:
+		return strconv.FormatFloat(t, 'g', -1, 64)
+	case bool:
+		return strconv.FormatBool(t)
+	case *big.Rat:
+		return ratToString(t)
+	case time.Time:
+		return t.UTC().Format(time.RFC3339Nano)
+	case civil.Date:
+		return t.String()
+	case civil.DateTime:
+		return bigquery.CivilDateTimeString(t)
+	case civil.Time:
+		return bigquery.CivilTimeString(t)
+	case []byte:
+		return base64.StdEncoding.EncodeToString(t)
 	default:
-		s = "invalid string"
+		return fmt.Sprint(v)
+	}
+}
+
+// ratToString formats a NUMERIC value as a decimal without trailing zeros.
+// NUMERIC values have at most 9 decimal digits, so the value is exact.
+func ratToString(r *big.Rat) string {
+	if r.IsInt() {
+		return r.Num().String()
 	}
-	return s
+	s := strings.TrimRight(bigquery.NumericString(r), "0")
+	return strings.TrimSuffix(s, ".")
 }
 
 // rowToMetric converts a bigquery result row to a bq.Metric
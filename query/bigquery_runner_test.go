@@ -1,13 +1,22 @@
 package query
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"math"
+	"math/big"
 	"reflect"
 	"testing"
+	"time"
 
 	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/civil"
+	"github.com/googleapis/google-cloud-go-testing/bigquery/bqiface"
+	"github.com/m-lab/prometheus-bigquery-exporter/internal/metrics"
+	"github.com/m-lab/prometheus-bigquery-exporter/internal/render"
 	"github.com/m-lab/prometheus-bigquery-exporter/sql"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 
 	"github.com/m-lab/go/cloud/bqfake"
 )
@@ -66,14 +75,14 @@ func TestRowToMetric(t *testing.T) {
 			},
 		},
 		{
-			name: "Bad label values are converted to strings",
+			name: "Non-string label values are converted to strings",
 			row: map[string]bigquery.Value{
-				"name":  3.0, // should be a string.
+				"name":  3.0,
 				"value": 2.1,
 			},
 			metric: sql.Metric{
 				LabelKeys:   []string{"name"},
-				LabelValues: []string{"invalid string"}, // converted to a string.
+				LabelValues: []string{"3"},
 				Values:      map[string]float64{"": 2.1},
 			},
 		},
@@ -100,22 +109,213 @@ func TestRowToMetric(t *testing.T) {
 	}
 }
 
+func TestValToFloat(t *testing.T) {
+	ts := time.Date(2020, 6, 1, 12, 30, 0, 500000000, time.UTC)
+	tests := []struct {
+		name string
+		v    bigquery.Value
+		want float64
+	}{
+		{name: "int64", v: int64(10), want: 10},
+		{name: "float64", v: 1.5, want: 1.5},
+		{name: "bool-true", v: true, want: 1},
+		{name: "bool-false", v: false, want: 0},
+		{name: "numeric", v: big.NewRat(5, 4), want: 1.25},
+		{name: "timestamp", v: ts, want: 1591014600.5},
+		{name: "date", v: civil.DateOf(ts), want: 1590969600},
+		{name: "datetime", v: civil.DateTimeOf(ts), want: 1591014600.5},
+		{name: "time", v: civil.TimeOf(ts), want: 45000.5},
+		{name: "null", v: nil, want: math.NaN()},
+		{name: "string", v: "1", want: math.NaN()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := valToFloat(tt.v)
+			if got != tt.want && !(math.IsNaN(got) && math.IsNaN(tt.want)) {
+				t.Errorf("valToFloat() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValToString(t *testing.T) {
+	ts := time.Date(2020, 6, 1, 12, 30, 0, 500000000, time.UTC)
+	tests := []struct {
+		name string
+		v    bigquery.Value
+		want string
+	}{
+		{name: "string", v: "foo", want: "foo"},
+		{name: "int64", v: int64(-10), want: "-10"},
+		{name: "float64", v: 0.25, want: "0.25"},
+		{name: "bool", v: true, want: "true"},
+		{name: "numeric-int", v: big.NewRat(20, 2), want: "10"},
+		{name: "numeric-fraction", v: big.NewRat(5, 4), want: "1.25"},
+		{name: "timestamp", v: ts.In(time.FixedZone("EST", -5*3600)), want: "2020-06-01T12:30:00.5Z"},
+		{name: "date", v: civil.DateOf(ts), want: "2020-06-01"},
+		{name: "datetime", v: civil.DateTimeOf(ts), want: "2020-06-01 12:30:00.500000"},
+		{name: "time", v: civil.TimeOf(ts), want: "12:30:00.500000"},
+		{name: "bytes", v: []byte("bqx"), want: "YnF4"},
+		{name: "null", v: nil, want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := valToString(tt.v); got != tt.want {
+				t.Errorf("valToString() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBQRunner_QueryNulls(t *testing.T) {
+	zero := 0.0
+	rows := []map[string]bigquery.Value{
+		{"site": "a", "value": 1.0},
+		{"site": nil, "value": 2.0},
+		{"site": "c", "value": nil},
+	}
+	bothNulls := []map[string]bigquery.Value{}
+	for i := 0; i < 20; i++ {
+		bothNulls = append(bothNulls, map[string]bigquery.Value{"site": nil, "value": nil})
+	}
+	tests := []struct {
+		name           string
+		skipNullLabels bool
+		skipNullValues bool
+		nullValue      *float64
+		histogram      bool
+		rows           []map[string]bigquery.Value
+		want           []float64
+		wantDropped    map[string]float64
+	}{
+		{
+			name: "empty-labels-nan-values",
+			rows: rows,
+			want: []float64{1, 2, math.NaN()},
+		},
+		{
+			name:           "skip-labels",
+			skipNullLabels: true,
+			rows:           rows,
+			want:           []float64{1, math.NaN()},
+			wantDropped:    map[string]float64{"null_label": 1},
+		},
+		{
+			name:           "skip-values",
+			skipNullValues: true,
+			rows:           rows,
+			want:           []float64{1, 2},
+			wantDropped:    map[string]float64{"null_value": 1},
+		},
+		{
+			name:      "default-values",
+			nullValue: &zero,
+			rows:      rows,
+			want:      []float64{1, 2, 0},
+		},
+		{
+			name:           "skip-labels-and-values",
+			skipNullLabels: true,
+			skipNullValues: true,
+			rows:           rows,
+			want:           []float64{1},
+			wantDropped:    map[string]float64{"null_label": 1, "null_value": 1},
+		},
+		{
+			name:           "skip-labels-and-values-both-null",
+			skipNullLabels: true,
+			skipNullValues: true,
+			// Repeat the row so that a reason chosen by map order is
+			// detected.
+			rows:        bothNulls,
+			want:        []float64{},
+			wantDropped: map[string]float64{"null_label": float64(len(bothNulls)), "null_value": 0},
+		},
+		{
+			name:           "skip-histogram-labels-ignores-bucket-columns",
+			skipNullLabels: true,
+			histogram:      true,
+			rows: []map[string]bigquery.Value{
+				{"site": "a", "bucket_1": nil, "value_sum": nil},
+			},
+			want: []float64{math.NaN()},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			qr := &BQRunner{
+				Name:           tt.name,
+				Histogram:      tt.histogram,
+				SkipNullLabels: tt.skipNullLabels,
+				SkipNullValues: tt.skipNullValues,
+				NullValue:      tt.nullValue,
+				runner:         &fakeQuery{rows: tt.rows},
+			}
+			got, err := qr.Query(context.Background(), "select * from `fake-table`")
+			if err != nil {
+				t.Fatalf("BQRunner.Query() error = %v", err)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("BQRunner.Query() = %d metrics, want %d", len(got), len(tt.want))
+			}
+			for i := range got {
+				v := got[i].Values[""]
+				if got[i].Histogram != nil {
+					v = got[i].Histogram.Sum
+				}
+				if v != tt.want[i] && !(math.IsNaN(v) && math.IsNaN(tt.want[i])) {
+					t.Errorf("BQRunner.Query() metric %d = %v, want %v", i, v, tt.want[i])
+				}
+			}
+			for reason, want := range tt.wantDropped {
+				if v := testutil.ToFloat64(metrics.RowsDropped.WithLabelValues(tt.name, reason)); v != want {
+					t.Errorf("bqx_query_rows_dropped_total{reason=%q} = %v, want %v", reason, v, want)
+				}
+			}
+		})
+	}
+	if rows[2]["value"] != nil {
+		t.Errorf("BQRunner.Query() modified result row: %v", rows[2])
+	}
+}
+
 type fakeQuery struct {
-	err  error
-	rows []map[string]bigquery.Value
+	err    error
+	rows   []map[string]bigquery.Value
+	schema bigquery.Schema
+	stats  *bigquery.JobStatistics
+	params []bigquery.QueryParameter
+	query  string
+	// block waits until the context is done.
+	block bool
+	// estimate and dryRunErr are returned by DryRun.
+	estimate  *bigquery.JobStatistics
+	dryRunErr error
+	maxBytes  int64
 }
 
-func (f *fakeQuery) Query(q string, visit func(row map[string]bigquery.Value) error) error {
+func (f *fakeQuery) DryRun(ctx context.Context, cfg jobConfig) (*bigquery.JobStatistics, error) {
+	return f.estimate, f.dryRunErr
+}
+
+func (f *fakeQuery) Query(ctx context.Context, cfg jobConfig, visit func(row map[string]bigquery.Value) error) (*queryResult, error) {
+	f.query = cfg.query.Q
+	f.params = cfg.query.Parameters
+	f.maxBytes = cfg.query.MaxBytesBilled
+	if f.block {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
 	if f.err != nil {
-		return f.err
+		return nil, f.err
 	}
 	for i := range f.rows {
 		err := visit(f.rows[i])
 		if err != nil {
-			return err
+			return nil, err
 		}
 	}
-	return nil
+	return &queryResult{schema: f.schema, stats: f.stats}, nil
 }
 
 func TestBQRunner_Query(t *testing.T) {
@@ -138,6 +338,26 @@ func TestBQRunner_Query(t *testing.T) {
 				sql.NewMetric(nil, nil, map[string]float64{"_name": 1.23}),
 			},
 		},
+		{
+			name: "okay-with-stats",
+			runner: &fakeQuery{
+				rows: []map[string]bigquery.Value{
+					{
+						"value": 1.23,
+					},
+				},
+				stats: &bigquery.JobStatistics{
+					TotalBytesProcessed: 100,
+					Details: &bigquery.QueryStatistics{
+						TotalBytesBilled: 1000,
+						CacheHit:         true,
+					},
+				},
+			},
+			want: []sql.Metric{
+				sql.NewMetric(nil, nil, map[string]float64{"": 1.23}),
+			},
+		},
 		{
 			name: "query-error",
 			runner: &fakeQuery{
@@ -150,8 +370,9 @@ func TestBQRunner_Query(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			qr := &BQRunner{
 				runner: tt.runner,
+				Name:   tt.name,
 			}
-			got, err := qr.Query("select * from `fake-table`")
+			got, err := qr.Query(context.Background(), "select * from `fake-table`")
 			if (err != nil) != tt.wantErr {
 				t.Errorf("BQRunner.Query() error = %v, wantErr %v", err, tt.wantErr)
 				return
@@ -163,17 +384,395 @@ func TestBQRunner_Query(t *testing.T) {
 	}
 }
 
+func TestBQRunner_QueryStats(t *testing.T) {
+	qr := &BQRunner{
+		Name: "stats_query",
+		runner: &fakeQuery{
+			stats: &bigquery.JobStatistics{
+				TotalBytesProcessed: 100,
+				Details: &bigquery.QueryStatistics{
+					TotalBytesBilled: 1000,
+					CacheHit:         true,
+				},
+			},
+		},
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := qr.Query(context.Background(), "select * from `fake-table`"); err != nil {
+			t.Fatalf("BQRunner.Query() error = %v", err)
+		}
+	}
+	if v := testutil.ToFloat64(metrics.QueryBytesProcessed.WithLabelValues("stats_query")); v != 200 {
+		t.Errorf("bqx_query_bytes_processed_total = %v, want 200", v)
+	}
+	if v := testutil.ToFloat64(metrics.QueryBytesBilled.WithLabelValues("stats_query")); v != 2000 {
+		t.Errorf("bqx_query_bytes_billed_total = %v, want 2000", v)
+	}
+	if v := testutil.ToFloat64(metrics.QueryCacheHit.WithLabelValues("stats_query")); v != 1 {
+		t.Errorf("bqx_query_cache_hit = %v, want 1", v)
+	}
+}
+
+func TestBQRunner_Schema(t *testing.T) {
+	tests := []struct {
+		name   string
+		qr     *BQRunner
+		schema bigquery.Schema
+		want   *sql.Metric
+	}{
+		{
+			name: "values",
+			qr:   &BQRunner{},
+			schema: bigquery.Schema{
+				{Name: "site", Type: bigquery.StringFieldType},
+				{Name: "value_count", Type: bigquery.IntegerFieldType},
+				{Name: "value_ratio", Type: bigquery.FloatFieldType},
+			},
+			want: &sql.Metric{
+				LabelKeys:   []string{"site"},
+				LabelValues: []string{"0"},
+				Values:      map[string]float64{"_count": 0, "_ratio": 0},
+			},
+		},
+		{
+			name: "histogram",
+			qr:   &BQRunner{Histogram: true},
+			schema: bigquery.Schema{
+				{Name: "site", Type: bigquery.StringFieldType},
+				{Name: "le", Type: bigquery.FloatFieldType},
+				{Name: "value", Type: bigquery.IntegerFieldType},
+			},
+			want: &sql.Metric{
+				LabelKeys:   []string{"site"},
+				LabelValues: []string{"0"},
+				Histogram:   &sql.Histogram{Buckets: map[float64]uint64{0: 0}},
+			},
+		},
+		{
+			name: "nested",
+			qr:   &BQRunner{},
+			schema: bigquery.Schema{
+				{Name: "stats", Type: bigquery.RecordFieldType, Schema: bigquery.Schema{
+					{Name: "value_p50", Type: bigquery.FloatFieldType},
+				}},
+				{Name: "sites", Type: bigquery.RecordFieldType, Repeated: true, Schema: bigquery.Schema{
+					{Name: "name", Type: bigquery.StringFieldType},
+				}},
+			},
+			want: &sql.Metric{
+				LabelKeys:   []string{"sites_name"},
+				LabelValues: []string{"0"},
+				Values:      map[string]float64{"_p50": 0},
+			},
+		},
+		{
+			name: "invalid-histogram-schema",
+			qr:   &BQRunner{Histogram: true},
+			schema: bigquery.Schema{
+				{Name: "value_sum", Type: bigquery.FloatFieldType},
+			},
+		},
+		{
+			name: "no-schema",
+			qr:   &BQRunner{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.qr.runner = &fakeQuery{schema: tt.schema}
+			got, err := tt.qr.Query(context.Background(), "select * from `fake-table`")
+			if err != nil || len(got) != 0 {
+				t.Fatalf("BQRunner.Query() = %v, %v, want no metrics", got, err)
+			}
+			if s := tt.qr.Schema(); !reflect.DeepEqual(s, tt.want) {
+				t.Errorf("BQRunner.Schema() = %#v, want %#v", s, tt.want)
+			}
+		})
+	}
+}
+
+func TestBQRunner_QueryParameters(t *testing.T) {
+	f := &fakeQuery{}
+	qr := &BQRunner{
+		runner:     f,
+		Parameters: []bigquery.QueryParameter{{Name: "site", Value: "lga03"}},
+	}
+	if _, err := qr.Query(context.Background(), "select @site, @now"); err != nil {
+		t.Fatalf("BQRunner.Query() error = %v", err)
+	}
+	if len(f.params) != 2 || f.params[0].Name != "now" || f.params[1] != qr.Parameters[0] {
+		t.Fatalf("BQRunner.Query() params = %v, want now and site", f.params)
+	}
+	if _, ok := f.params[0].Value.(time.Time); !ok {
+		t.Errorf("BQRunner.Query() now = %#v, want time.Time", f.params[0].Value)
+	}
+}
+
+func TestBQRunner_QueryTemplate(t *testing.T) {
+	f := &fakeQuery{}
+	qr := &BQRunner{
+		runner:  f,
+		Context: &render.Context{Refresh: time.Minute},
+	}
+	if _, err := qr.Query(context.Background(), "{{.Now.Unix}} {{.WindowEnd.Unix}}"); err != nil {
+		t.Fatalf("BQRunner.Query() error = %v", err)
+	}
+	now := f.params[0].Value.(time.Time)
+	want := fmt.Sprintf("%d %d", now.Unix(), now.Truncate(time.Minute).Unix())
+	if f.query != want {
+		t.Errorf("BQRunner.Query() rendered %q, want %q", f.query, want)
+	}
+	if _, err := qr.Query(context.Background(), "{{.Vars.missing}}"); err == nil {
+		t.Errorf("BQRunner.Query() expected error for missing template variable")
+	}
+}
+
+func TestBQRunner_QueryTimeout(t *testing.T) {
+	qr := &BQRunner{
+		runner:  &fakeQuery{block: true},
+		Timeout: time.Millisecond,
+	}
+	_, err := qr.Query(context.Background(), "select * from `fake-table`")
+	if err != context.DeadlineExceeded {
+		t.Errorf("BQRunner.Query() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestBigQueryImpl_QueryCancel(t *testing.T) {
+	for _, done := range []bool{false, true} {
+		job := &fakeJob{status: &bigquery.JobStatus{}}
+		b := &bigQueryImpl{Client: &fakeClient{query: &fakeBQQuery{job: job}}}
+		ctx, cancel := context.WithCancel(context.Background())
+		if done {
+			cancel()
+		}
+		b.Query(ctx, jobConfig{query: bigquery.QueryConfig{Q: "select 1"}}, nil)
+		cancel()
+		if job.cancelled != done {
+			t.Errorf("bigQueryImpl.Query() cancelled job = %t, want %t", job.cancelled, done)
+		}
+	}
+}
+
+func TestBQRunner_QueryEstimate(t *testing.T) {
+	tests := []struct {
+		name     string
+		maxBytes int64
+		runner   *fakeQuery
+		wantErr  error
+	}{
+		{
+			name:     "under-budget",
+			maxBytes: 1000,
+			runner:   &fakeQuery{estimate: &bigquery.JobStatistics{TotalBytesProcessed: 1000}},
+		},
+		{
+			name:   "no-budget",
+			runner: &fakeQuery{estimate: &bigquery.JobStatistics{TotalBytesProcessed: 1000}},
+		},
+		{
+			name:     "no-estimate",
+			maxBytes: 1000,
+			runner:   &fakeQuery{},
+		},
+		{
+			name:     "over-budget",
+			maxBytes: 1000,
+			runner:   &fakeQuery{estimate: &bigquery.JobStatistics{TotalBytesProcessed: 1001}},
+			wantErr:  ErrOverBudget,
+		},
+		{
+			name: "bignumeric",
+			runner: &fakeQuery{estimate: &bigquery.JobStatistics{
+				Details: &bigquery.QueryStatistics{Schema: bigquery.Schema{
+					{Name: "stats", Type: bigquery.RecordFieldType, Schema: bigquery.Schema{
+						{Name: "value", Type: "BIGNUMERIC"},
+					}},
+				}},
+			}},
+			wantErr: ErrBigNumeric,
+		},
+		{
+			name:    "dry-run-error",
+			runner:  &fakeQuery{dryRunErr: fmt.Errorf("fake dry run error")},
+			wantErr: fmt.Errorf("fake dry run error"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			qr := &BQRunner{Name: tt.name, runner: tt.runner, MaxBytesBilled: tt.maxBytes}
+			_, err := qr.Query(context.Background(), "select 1")
+			if (err != nil) != (tt.wantErr != nil) || (tt.wantErr == ErrOverBudget || tt.wantErr == ErrBigNumeric) && !errors.Is(err, tt.wantErr) {
+				t.Fatalf("BQRunner.Query() error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && tt.runner.maxBytes != tt.maxBytes {
+				t.Errorf("BQRunner.Query() max bytes billed = %d, want %d", tt.runner.maxBytes, tt.maxBytes)
+			}
+			over := testutil.ToFloat64(metrics.QueryOverBudget.WithLabelValues(tt.name))
+			if (over == 1) != (tt.wantErr == ErrOverBudget) {
+				t.Errorf("bqx_query_over_budget_total = %v", over)
+			}
+		})
+	}
+}
+
+func TestBigQueryImpl_DryRun(t *testing.T) {
+	stats := &bigquery.JobStatistics{TotalBytesProcessed: 10}
+	q := &fakeBQQuery{job: &fakeJob{status: &bigquery.JobStatus{Statistics: stats}}}
+	b := &bigQueryImpl{Client: &fakeClient{query: q}}
+	got, err := b.DryRun(context.Background(), jobConfig{query: bigquery.QueryConfig{Q: "select 1"}})
+	if err != nil || got != stats || !q.config.DryRun {
+		t.Errorf("bigQueryImpl.DryRun() = %v, %v, dry run %t; want %v", got, err, q.config.DryRun, stats)
+	}
+	q.job.status = nil
+	if got, err := b.DryRun(context.Background(), jobConfig{}); got != nil || err != nil {
+		t.Errorf("bigQueryImpl.DryRun() = %v, %v; want nil, nil", got, err)
+	}
+	q.runErr = fmt.Errorf("fake run error")
+	if _, err := b.DryRun(context.Background(), jobConfig{}); err == nil {
+		t.Errorf("bigQueryImpl.DryRun() expected error")
+	}
+}
+
+func TestBQRunner_jobConfig(t *testing.T) {
+	qr := &BQRunner{
+		MaxBytesBilled:    100,
+		Location:          "EU",
+		Priority:          bigquery.BatchPriority,
+		DisableQueryCache: true,
+		Labels:            map[string]string{"exporter": "bqx"},
+		JobIDPrefix:       "bqx_widgets",
+	}
+	now := time.Now()
+	want := jobConfig{
+		query: bigquery.QueryConfig{
+			Q:                 "select 1",
+			Parameters:        []bigquery.QueryParameter{{Name: "now", Value: now}},
+			MaxBytesBilled:    100,
+			Priority:          bigquery.BatchPriority,
+			DisableQueryCache: true,
+			Labels:            map[string]string{"exporter": "bqx"},
+		},
+		id: bigquery.JobIDConfig{JobID: "bqx_widgets", AddJobIDSuffix: true, Location: "EU"},
+	}
+	if got := qr.jobConfig("select 1", now); !reflect.DeepEqual(got, want) {
+		t.Errorf("BQRunner.jobConfig() = %#v, want %#v", got, want)
+	}
+}
+
+func TestBigQueryImpl_QueryParameters(t *testing.T) {
+	q := &fakeBQQuery{runErr: fmt.Errorf("fake run error")}
+	b := &bigQueryImpl{Client: &fakeClient{query: q}}
+	params := []bigquery.QueryParameter{{Name: "a", Value: int64(1)}}
+	id := bigquery.JobIDConfig{JobID: "bqx", AddJobIDSuffix: true, Location: "EU"}
+	b.Query(context.Background(), jobConfig{
+		query: bigquery.QueryConfig{Q: "select @a", Parameters: params},
+		id:    id,
+	}, nil)
+	if q.config.Q != "select @a" || !reflect.DeepEqual(q.config.Parameters, params) {
+		t.Errorf("bigQueryImpl.Query() config = %#v, want query and parameters", q.config.QueryConfig)
+	}
+	if q.id != id {
+		t.Errorf("bigQueryImpl.Query() job ID config = %#v, want %#v", q.id, id)
+	}
+}
+
 func TestNewBQRunner(t *testing.T) {
 	NewBQRunner(nil)
 }
 
+// fakeJob implements the parts of bqiface.Job used by bigQueryImpl. Rows are
+// read using the bqfake query configuration.
+type fakeJob struct {
+	bqiface.Job
+	config    bqfake.QueryConfig
+	schema    bigquery.Schema
+	status    *bigquery.JobStatus
+	statusErr error
+	cancelled bool
+}
+
+func (j *fakeJob) LastStatus() *bigquery.JobStatus {
+	return j.status
+}
+
+func (j *fakeJob) Cancel(ctx context.Context) error {
+	j.cancelled = true
+	return nil
+}
+
+// fakeRowIterator adds a schema to the bqfake row iterator.
+type fakeRowIterator struct {
+	bqiface.RowIterator
+	schema bigquery.Schema
+}
+
+func (it *fakeRowIterator) Schema() bigquery.Schema {
+	return it.schema
+}
+
+func (j *fakeJob) ID() string {
+	return "fake-job"
+}
+
+func (j *fakeJob) Read(ctx context.Context) (bqiface.RowIterator, error) {
+	it, err := bqfake.NewQueryReadClient(j.config).Query("").Read(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &fakeRowIterator{RowIterator: it, schema: j.schema}, nil
+}
+
+func (j *fakeJob) Status(ctx context.Context) (*bigquery.JobStatus, error) {
+	return j.status, j.statusErr
+}
+
+// fakeBQQuery implements the parts of bqiface.Query used by bigQueryImpl.
+type fakeBQQuery struct {
+	bqiface.Query
+	job    *fakeJob
+	runErr error
+	config bqiface.QueryConfig
+	id     bigquery.JobIDConfig
+}
+
+func (q *fakeBQQuery) JobIDConfig() *bigquery.JobIDConfig {
+	return &q.id
+}
+
+func (q *fakeBQQuery) SetQueryConfig(c bqiface.QueryConfig) {
+	q.config = c
+}
+
+func (q *fakeBQQuery) Run(ctx context.Context) (bqiface.Job, error) {
+	if q.runErr != nil {
+		return nil, q.runErr
+	}
+	return q.job, nil
+}
+
+// fakeClient implements the parts of bqiface.Client used by bigQueryImpl.
+type fakeClient struct {
+	bqiface.Client
+	query *fakeBQQuery
+}
+
+func (c *fakeClient) Query(string) bqiface.Query {
+	return c.query
+}
+
 func TestBigQueryImpl_Query(t *testing.T) {
+	stats := &bigquery.JobStatistics{TotalBytesProcessed: 10}
+	schema := bigquery.Schema{{Name: "value", Type: bigquery.FloatFieldType}}
 	tests := []struct {
-		name    string
-		config  bqfake.QueryConfig
-		query   string
-		visit   func(row map[string]bigquery.Value) error
-		wantErr bool
+		name      string
+		config    bqfake.QueryConfig
+		runErr    error
+		statusErr error
+		query     string
+		visit     func(row map[string]bigquery.Value) error
+		want      *queryResult
+		wantErr   bool
 	}{
 		{
 			name: "success-iteration",
@@ -185,6 +784,27 @@ func TestBigQueryImpl_Query(t *testing.T) {
 			visit: func(row map[string]bigquery.Value) error {
 				return nil
 			},
+			want: &queryResult{schema: schema, stats: stats},
+		},
+		{
+			name: "success-no-rows",
+			visit: func(row map[string]bigquery.Value) error {
+				return nil
+			},
+			want: &queryResult{schema: schema, stats: stats},
+		},
+		{
+			name: "success-status-error",
+			config: bqfake.QueryConfig{
+				RowIteratorConfig: bqfake.RowIteratorConfig{
+					Rows: []map[string]bigquery.Value{{"value": 1.234}},
+				},
+			},
+			statusErr: fmt.Errorf("This is a fake status error"),
+			visit: func(row map[string]bigquery.Value) error {
+				return nil
+			},
+			want: &queryResult{schema: schema},
 		},
 		{
 			name: "visit-error",
@@ -198,6 +818,11 @@ func TestBigQueryImpl_Query(t *testing.T) {
 			},
 			wantErr: true,
 		},
+		{
+			name:    "run-error",
+			runErr:  fmt.Errorf("This is a fake run error"),
+			wantErr: true,
+		},
 		{
 			name: "read-error",
 			config: bqfake.QueryConfig{
@@ -217,13 +842,27 @@ func TestBigQueryImpl_Query(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			client := bqfake.NewQueryReadClient(tt.config)
+			client := &fakeClient{
+				query: &fakeBQQuery{
+					runErr: tt.runErr,
+					job: &fakeJob{
+						config:    tt.config,
+						schema:    schema,
+						status:    &bigquery.JobStatus{Statistics: stats},
+						statusErr: tt.statusErr,
+					},
+				},
+			}
 			b := &bigQueryImpl{
 				Client: client,
 			}
-			if err := b.Query(tt.query, tt.visit); (err != nil) != tt.wantErr {
+			got, err := b.Query(context.Background(), jobConfig{query: bigquery.QueryConfig{Q: tt.query}}, tt.visit)
+			if (err != nil) != tt.wantErr {
 				t.Errorf("bigQueryImpl.Query() error = %v, wantErr %v", err, tt.wantErr)
 			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("bigQueryImpl.Query() = %#v, want %#v", got, tt.want)
+			}
 		})
 	}
 }
@@ -0,0 +1,53 @@
+package query
+
+import (
+	"fmt"
+	"sort"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/m-lab/prometheus-bigquery-exporter/sql"
+)
+
+// rowToDeclaredMetric converts a bigquery result row into a sql.Metric using
+// the declared label columns, and value columns mapped to metric suffixes.
+// Every declared column must be present in the row, and undeclared columns
+// are an error, so that a misnamed column is not silently exported.
+func rowToDeclaredMetric(row map[string]bigquery.Value, labels []string, values map[string]string) (sql.Metric, error) {
+	for k := range row {
+		if _, ok := values[k]; !ok && !contains(labels, k) {
+			return sql.Metric{}, fmt.Errorf("undeclared column %q", k)
+		}
+	}
+	labelKeys := append([]string{}, labels...)
+	sort.Strings(labelKeys)
+	var labelValues []string
+	for _, k := range labelKeys {
+		v, ok := row[k]
+		if !ok {
+			return sql.Metric{}, fmt.Errorf("missing label column %q", k)
+		}
+		labelValues = append(labelValues, valToString(v))
+	}
+	if len(labelKeys) == 0 {
+		labelKeys = nil
+	}
+	m := make(map[string]float64, len(values))
+	for k, suffix := range values {
+		v, ok := row[k]
+		if !ok {
+			return sql.Metric{}, fmt.Errorf("missing value column %q", k)
+		}
+		m[suffix] = valToFloat(v)
+	}
+	return sql.NewMetric(labelKeys, labelValues, m), nil
+}
+
+// contains returns true if s is in list.
+func contains(list []string, s string) bool {
+	for i := range list {
+		if list[i] == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,91 @@
+package query
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/m-lab/prometheus-bigquery-exporter/sql"
+)
+
+func TestRowToDeclaredMetric(t *testing.T) {
+	labels := []string{"valuation", "site"}
+	values := map[string]string{"tests": "", "bytes": "_bytes"}
+	tests := []struct {
+		name    string
+		row     map[string]bigquery.Value
+		want    sql.Metric
+		wantErr bool
+	}{
+		{
+			name: "success",
+			row: map[string]bigquery.Value{
+				"site":      "a",
+				"valuation": "high",
+				"tests":     int64(2),
+				"bytes":     1.5,
+			},
+			want: sql.NewMetric(
+				[]string{"site", "valuation"}, []string{"a", "high"},
+				map[string]float64{"": 2, "_bytes": 1.5}),
+		},
+		{
+			name:    "error-missing-label",
+			row:     map[string]bigquery.Value{"site": "a", "tests": int64(2), "bytes": 1.5},
+			wantErr: true,
+		},
+		{
+			name:    "error-missing-value",
+			row:     map[string]bigquery.Value{"site": "a", "valuation": "high", "tests": int64(2)},
+			wantErr: true,
+		},
+		{
+			name: "error-undeclared-column",
+			row: map[string]bigquery.Value{
+				"site": "a", "valuation": "high", "tests": int64(2), "bytes": 1.5, "value": 1.0,
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := rowToDeclaredMetric(tt.row, labels, values)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("rowToDeclaredMetric() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("rowToDeclaredMetric() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBQRunner_QueryDeclaredColumns(t *testing.T) {
+	qr := &BQRunner{
+		ValueColumns: map[string]string{"tests": "_count"},
+		runner: &fakeQuery{
+			rows: []map[string]bigquery.Value{{"tests": int64(3)}},
+			schema: bigquery.Schema{
+				{Name: "tests", Type: bigquery.IntegerFieldType},
+			},
+		},
+	}
+	got, err := qr.Query(context.Background(), "select * from `fake-table`")
+	if err != nil {
+		t.Fatalf("BQRunner.Query() error = %v", err)
+	}
+	want := []sql.Metric{sql.NewMetric(nil, nil, map[string]float64{"_count": 3})}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("BQRunner.Query() = %#v, want %#v", got, want)
+	}
+	if s := qr.Schema(); s == nil || !reflect.DeepEqual(s.Values, map[string]float64{"_count": 0}) {
+		t.Errorf("BQRunner.Schema() = %#v, want value _count", s)
+	}
+
+	qr.runner = &fakeQuery{rows: []map[string]bigquery.Value{{"valuation": "high", "tests": int64(3)}}}
+	if _, err := qr.Query(context.Background(), "select * from `fake-table`"); err == nil {
+		t.Errorf("BQRunner.Query() expected error for undeclared column")
+	}
+}
@@ -0,0 +1,169 @@
+package query
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"cloud.google.com/go/bigquery"
+)
+
+// flatName returns the name of the column flattened from the field of a
+// STRUCT column. Value fields keep their own name, so that e.g. field
+// "value_p50" of "stats" is the value column "value_p50". All other fields are
+// prefixed with the name of the parent column, so that e.g. field "host" of
+// "machine" is the column "machine_host".
+func flatName(parent, field string) string {
+	if strings.HasPrefix(field, "value") {
+		return field
+	}
+	return parent + "_" + field
+}
+
+// sortedKeys returns the keys of m in sorted order.
+func sortedKeys(m map[string]bigquery.Value) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// copyRows returns a shallow copy of every row.
+func copyRows(rows []map[string]bigquery.Value) []map[string]bigquery.Value {
+	c := make([]map[string]bigquery.Value, len(rows))
+	for i, row := range rows {
+		c[i] = make(map[string]bigquery.Value, len(row))
+		for k, v := range row {
+			c[i][k] = v
+		}
+	}
+	return c
+}
+
+// expandNulls replaces every NULL STRUCT in row with a STRUCT of NULL fields,
+// as described by the result schema, so that NULL STRUCTs are flattened into
+// the same columns as other rows and the NULL policies apply to every field.
+func expandNulls(row map[string]bigquery.Value, schema bigquery.Schema) {
+	for _, f := range schema {
+		if f.Schema == nil {
+			continue
+		}
+		switch v := row[f.Name].(type) {
+		case nil:
+			if f.Repeated {
+				continue
+			}
+			fields := make(map[string]bigquery.Value, len(f.Schema))
+			for _, sf := range f.Schema {
+				fields[sf.Name] = nil
+			}
+			expandNulls(fields, f.Schema)
+			row[f.Name] = fields
+		case map[string]bigquery.Value:
+			expandNulls(v, f.Schema)
+		case []bigquery.Value:
+			for _, e := range v {
+				if m, ok := e.(map[string]bigquery.Value); ok {
+					expandNulls(m, f.Schema)
+				}
+			}
+		}
+	}
+}
+
+// isNested returns true if v is a STRUCT, or an ARRAY that is not a value
+// column. Only ARRAY<STRUCT> columns are expected, since labels cannot be
+// arrays.
+func isNested(name string, v bigquery.Value) bool {
+	switch v.(type) {
+	case map[string]bigquery.Value:
+		return true
+	case []bigquery.Value:
+		return !strings.HasPrefix(name, "value")
+	default:
+		return false
+	}
+}
+
+// flattenColumn sets the column name to v in every row, flattening v if it is
+// nested. A STRUCT is flattened into one column per field, named by flatName.
+// An ARRAY is unnested into one copy of every row per element, so an empty
+// ARRAY results in no rows.
+func flattenColumn(rows []map[string]bigquery.Value, name string, v bigquery.Value) ([]map[string]bigquery.Value, error) {
+	var err error
+	switch t := v.(type) {
+	case map[string]bigquery.Value:
+		for _, k := range sortedKeys(t) {
+			rows, err = flattenColumn(rows, flatName(name, k), t[k])
+			if err != nil {
+				return nil, err
+			}
+		}
+		return rows, nil
+	case []bigquery.Value:
+		if strings.HasPrefix(name, "value") {
+			break
+		}
+		unnested := []map[string]bigquery.Value{}
+		for _, e := range t {
+			r, err := flattenColumn(copyRows(rows), name, e)
+			if err != nil {
+				return nil, err
+			}
+			unnested = append(unnested, r...)
+		}
+		return unnested, nil
+	}
+	for _, row := range rows {
+		if _, ok := row[name]; ok {
+			return nil, fmt.Errorf("duplicate flattened column %q", name)
+		}
+		row[name] = v
+	}
+	return rows, nil
+}
+
+// flattenRow converts a result row with nested STRUCT and ARRAY<STRUCT>
+// columns into one or more rows with only top level columns. Rows without
+// nested columns are returned as-is.
+func flattenRow(row map[string]bigquery.Value) ([]map[string]bigquery.Value, error) {
+	nested := false
+	for k, v := range row {
+		if isNested(k, v) {
+			nested = true
+			break
+		}
+	}
+	if !nested {
+		return []map[string]bigquery.Value{row}, nil
+	}
+	var err error
+	rows := []map[string]bigquery.Value{{}}
+	for _, k := range sortedKeys(row) {
+		rows, err = flattenColumn(rows, k, row[k])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return rows, nil
+}
+
+// flatten returns a visit function that flattens every row and passes the
+// resulting rows to visit.
+func flatten(visit func(row map[string]bigquery.Value) error) func(row map[string]bigquery.Value) error {
+	return func(row map[string]bigquery.Value) error {
+		rows, err := flattenRow(row)
+		if err != nil {
+			return err
+		}
+		for _, r := range rows {
+			err = visit(r)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
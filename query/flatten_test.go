@@ -0,0 +1,223 @@
+package query
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/m-lab/go/cloud/bqfake"
+	"github.com/m-lab/prometheus-bigquery-exporter/sql"
+)
+
+func TestFlattenRow(t *testing.T) {
+	tests := []struct {
+		name    string
+		row     map[string]bigquery.Value
+		want    []map[string]bigquery.Value
+		wantErr bool
+	}{
+		{
+			name: "flat",
+			row:  map[string]bigquery.Value{"site": "a", "value": []bigquery.Value{1.0}},
+			want: []map[string]bigquery.Value{
+				{"site": "a", "value": []bigquery.Value{1.0}},
+			},
+		},
+		{
+			name: "struct",
+			row: map[string]bigquery.Value{
+				"machine": map[string]bigquery.Value{"host": "mlab1", "site": "a"},
+				"stats":   map[string]bigquery.Value{"value_p50": 1.0, "value_p90": 2.0},
+			},
+			want: []map[string]bigquery.Value{
+				{"machine_host": "mlab1", "machine_site": "a", "value_p50": 1.0, "value_p90": 2.0},
+			},
+		},
+		{
+			name: "struct-value-fields",
+			row: map[string]bigquery.Value{
+				"value": map[string]bigquery.Value{"p50": 1.0},
+			},
+			want: []map[string]bigquery.Value{
+				{"value_p50": 1.0},
+			},
+		},
+		{
+			name: "array-of-structs",
+			row: map[string]bigquery.Value{
+				"day": "monday",
+				"by_site": []bigquery.Value{
+					map[string]bigquery.Value{"site": "a", "value": int64(1)},
+					map[string]bigquery.Value{"site": "b", "value": int64(2)},
+				},
+			},
+			want: []map[string]bigquery.Value{
+				{"day": "monday", "by_site_site": "a", "value": int64(1)},
+				{"day": "monday", "by_site_site": "b", "value": int64(2)},
+			},
+		},
+		{
+			name: "empty-array",
+			row: map[string]bigquery.Value{
+				"day":     "monday",
+				"by_site": []bigquery.Value{},
+			},
+			want: []map[string]bigquery.Value{},
+		},
+		{
+			name: "error-duplicate-column",
+			row: map[string]bigquery.Value{
+				"stats": map[string]bigquery.Value{"value": 1.0},
+				"value": 2.0,
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := flattenRow(tt.row)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("flattenRow() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("flattenRow() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBQRunner_QueryNested(t *testing.T) {
+	qr := &BQRunner{
+		runner: &fakeQuery{
+			rows: []map[string]bigquery.Value{
+				{
+					"by_site": []bigquery.Value{
+						map[string]bigquery.Value{"site": "a", "value": int64(1)},
+						map[string]bigquery.Value{"site": "b", "value": int64(2)},
+					},
+				},
+			},
+		},
+	}
+	got, err := qr.Query(context.Background(), "select * from `fake-table`")
+	if err != nil {
+		t.Fatalf("BQRunner.Query() error = %v", err)
+	}
+	want := []sql.Metric{
+		sql.NewMetric([]string{"by_site_site"}, []string{"a"}, map[string]float64{"": 1}),
+		sql.NewMetric([]string{"by_site_site"}, []string{"b"}, map[string]float64{"": 2}),
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("BQRunner.Query() = %#v, want %#v", got, want)
+	}
+	if qr.RowCount() != 1 {
+		t.Errorf("BQRunner.RowCount() = %d, want 1", qr.RowCount())
+	}
+
+	qr.runner = &fakeQuery{
+		rows: []map[string]bigquery.Value{
+			{"stats": map[string]bigquery.Value{"value": 1.0}, "value": 2.0},
+		},
+	}
+	if _, err := qr.Query(context.Background(), "select * from `fake-table`"); err == nil {
+		t.Errorf("BQRunner.Query() expected error for duplicate flattened column")
+	}
+}
+
+func TestExpandNulls(t *testing.T) {
+	schema := bigquery.Schema{
+		{Name: "site", Type: bigquery.StringFieldType},
+		{Name: "stats", Type: bigquery.RecordFieldType, Schema: bigquery.Schema{
+			{Name: "value_p50", Type: bigquery.FloatFieldType},
+			{Name: "machine", Type: bigquery.RecordFieldType, Schema: bigquery.Schema{
+				{Name: "host", Type: bigquery.StringFieldType},
+			}},
+		}},
+		{Name: "by_day", Type: bigquery.RecordFieldType, Repeated: true, Schema: bigquery.Schema{
+			{Name: "day", Type: bigquery.StringFieldType},
+			{Name: "info", Type: bigquery.RecordFieldType, Schema: bigquery.Schema{
+				{Name: "value", Type: bigquery.FloatFieldType},
+			}},
+		}},
+	}
+	row := map[string]bigquery.Value{
+		"site":  "b",
+		"stats": nil,
+		"by_day": []bigquery.Value{
+			map[string]bigquery.Value{"day": "monday", "info": nil},
+		},
+	}
+	want := map[string]bigquery.Value{
+		"site": "b",
+		"stats": map[string]bigquery.Value{
+			"value_p50": nil,
+			"machine":   map[string]bigquery.Value{"host": nil},
+		},
+		"by_day": []bigquery.Value{
+			map[string]bigquery.Value{"day": "monday", "info": map[string]bigquery.Value{"value": nil}},
+		},
+	}
+	expandNulls(row, schema)
+	if !reflect.DeepEqual(row, want) {
+		t.Errorf("expandNulls() = %#v, want %#v", row, want)
+	}
+}
+
+func TestBQRunner_QueryNullStruct(t *testing.T) {
+	schema := bigquery.Schema{
+		{Name: "site", Type: bigquery.StringFieldType},
+		{Name: "stats", Type: bigquery.RecordFieldType, Schema: bigquery.Schema{
+			{Name: "value_p50", Type: bigquery.FloatFieldType},
+		}},
+	}
+	newRunner := func() *bigQueryImpl {
+		job := &fakeJob{
+			config: bqfake.QueryConfig{
+				RowIteratorConfig: bqfake.RowIteratorConfig{
+					Rows: []map[string]bigquery.Value{
+						{"site": "a", "stats": map[string]bigquery.Value{"value_p50": 1.0}},
+						{"site": "b", "stats": nil},
+					},
+				},
+			},
+			schema: schema,
+			status: &bigquery.JobStatus{},
+		}
+		return &bigQueryImpl{Client: &fakeClient{query: &fakeBQQuery{job: job}}}
+	}
+	zero := 0.0
+	tests := []struct {
+		name string
+		qr   *BQRunner
+		want []sql.Metric
+	}{
+		{
+			name: "skip",
+			qr:   &BQRunner{runner: newRunner(), Name: "null_struct", SkipNullValues: true},
+			want: []sql.Metric{
+				sql.NewMetric([]string{"site"}, []string{"a"}, map[string]float64{"_p50": 1}),
+			},
+		},
+		{
+			name: "default",
+			qr:   &BQRunner{runner: newRunner(), Name: "null_struct", NullValue: &zero},
+			want: []sql.Metric{
+				sql.NewMetric([]string{"site"}, []string{"a"}, map[string]float64{"_p50": 1}),
+				sql.NewMetric([]string{"site"}, []string{"b"}, map[string]float64{"_p50": 0}),
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.qr.Query(context.Background(), "select * from `fake-table`")
+			if err != nil {
+				t.Fatalf("BQRunner.Query() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("BQRunner.Query() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
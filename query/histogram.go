@@ -0,0 +1,168 @@
+package query
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/m-lab/prometheus-bigquery-exporter/sql"
+)
+
+// Histogram query column names.
+const (
+	leColumn     = "le"
+	bucketPrefix = "bucket_"
+	sumColumn    = "value_sum"
+	countColumn  = "value_count"
+)
+
+// parseBound converts a bucket upper bound into a float64. Numeric bounds are
+// used as-is, and strings are parsed as floats, e.g. "0.5" or "+Inf".
+func parseBound(v bigquery.Value) (float64, error) {
+	switch b := v.(type) {
+	case int64:
+		return float64(b), nil
+	case float64:
+		return b, nil
+	case string:
+		return strconv.ParseFloat(b, 64)
+	default:
+		return 0, fmt.Errorf("unsupported bucket bound type %T", v)
+	}
+}
+
+// columnToBound converts the suffix of a bucket column name into a bucket
+// upper bound. Because column names may not contain a '.', the first '_' is
+// the decimal point, e.g. "bucket_0_25" is 0.25, and "bucket_inf" is +Inf.
+func columnToBound(name string) (float64, error) {
+	s := strings.Replace(strings.TrimPrefix(name, bucketPrefix), "_", ".", 1)
+	return strconv.ParseFloat(s, 64)
+}
+
+// toCount converts a query value into an observation count. Invalid counts
+// are treated as zero.
+func toCount(v float64) uint64 {
+	if math.IsNaN(v) || v < 0 {
+		return 0
+	}
+	return uint64(v)
+}
+
+// rowToHistogram converts a bigquery result row into a sql.Metric with a
+// Histogram. Rows may either hold a single bucket, with an "le" column for the
+// bucket upper bound and a "value" column for the cumulative count, or hold
+// all buckets, with one "bucket_<bound>" column per bucket. Both forms may
+// define "value_sum" and "value_count" columns. All other columns are labels.
+func rowToHistogram(row map[string]bigquery.Value) (sql.Metric, error) {
+	h := &sql.Histogram{Buckets: map[float64]uint64{}}
+	var labelKeys []string
+	var labelValues []string
+	var err error
+	count := 0.0
+
+	for k, v := range row {
+		var bound float64
+		switch {
+		case k == leColumn:
+			bound, err = parseBound(v)
+			if err != nil {
+				return sql.Metric{}, fmt.Errorf("column %q: %v", k, err)
+			}
+			c, ok := row["value"]
+			if !ok {
+				return sql.Metric{}, fmt.Errorf("column %q requires column %q", k, "value")
+			}
+			h.Buckets[bound] = toCount(valToFloat(c))
+		case strings.HasPrefix(k, bucketPrefix):
+			bound, err = columnToBound(k)
+			if err != nil {
+				return sql.Metric{}, fmt.Errorf("column %q: invalid bucket bound", k)
+			}
+			h.Buckets[bound] = toCount(valToFloat(v))
+		case k == sumColumn:
+			h.Sum = valToFloat(v)
+		case k == countColumn:
+			count = valToFloat(v)
+		case k == "value":
+			if _, ok := row[leColumn]; !ok {
+				return sql.Metric{}, fmt.Errorf("column %q requires column %q", k, leColumn)
+			}
+		case strings.HasPrefix(k, "value"):
+			return sql.Metric{}, fmt.Errorf("unsupported histogram column %q", k)
+		default:
+			labelKeys = append(labelKeys, k)
+		}
+	}
+	if len(h.Buckets) == 0 {
+		return sql.Metric{}, fmt.Errorf("histogram rows must define %q or %q columns", leColumn, bucketPrefix+"*")
+	}
+	h.Count = toCount(count)
+	sort.Strings(labelKeys)
+	for i := range labelKeys {
+		labelValues = append(labelValues, valToString(row[labelKeys[i]]))
+	}
+	return sql.Metric{LabelKeys: labelKeys, LabelValues: labelValues, Histogram: h}, nil
+}
+
+// mergeHistogram adds the buckets, sum and count from src into dst.
+func mergeHistogram(dst, src *sql.Histogram) {
+	for b, c := range src.Buckets {
+		dst.Buckets[b] = c
+	}
+	if src.Sum != 0 {
+		dst.Sum = src.Sum
+	}
+	if src.Count != 0 {
+		dst.Count = src.Count
+	}
+}
+
+// finishHistogram completes a histogram once all rows are read. The +Inf
+// bucket is implied by the total count, so it is removed from the buckets and
+// used as the count if no count was given.
+func finishHistogram(h *sql.Histogram) {
+	inf := math.Inf(1)
+	if c, ok := h.Buckets[inf]; ok {
+		if h.Count == 0 {
+			h.Count = c
+		}
+		delete(h.Buckets, inf)
+	}
+	for _, c := range h.Buckets {
+		if c > h.Count {
+			h.Count = c
+		}
+	}
+}
+
+// queryHistograms runs the query and converts the results into histograms.
+// Rows with the same labels are merged into a single histogram.
+func (qr *BQRunner) queryHistograms(ctx context.Context, query string) ([]sql.Metric, error) {
+	metrics := []sql.Metric{}
+	index := map[string]int{}
+	err := qr.run(ctx, query, func(row map[string]bigquery.Value) error {
+		m, err := rowToHistogram(row)
+		if err != nil {
+			return err
+		}
+		key := strings.Join(m.LabelValues, "\xff")
+		if i, ok := index[key]; ok {
+			mergeHistogram(metrics[i].Histogram, m.Histogram)
+			return nil
+		}
+		index[key] = len(metrics)
+		metrics = append(metrics, m)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for i := range metrics {
+		finishHistogram(metrics[i].Histogram)
+	}
+	return metrics, nil
+}
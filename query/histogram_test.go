@@ -0,0 +1,155 @@
+package query
+
+import (
+	"context"
+	"math"
+	"reflect"
+	"testing"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/m-lab/prometheus-bigquery-exporter/sql"
+)
+
+func TestRowToHistogram(t *testing.T) {
+	tests := []struct {
+		name    string
+		row     map[string]bigquery.Value
+		want    sql.Metric
+		wantErr bool
+	}{
+		{
+			name: "le-bucket",
+			row: map[string]bigquery.Value{
+				"site":      "foo01",
+				"le":        0.5,
+				"value":     int64(3),
+				"value_sum": 1.25,
+			},
+			want: sql.Metric{
+				LabelKeys:   []string{"site"},
+				LabelValues: []string{"foo01"},
+				Histogram: &sql.Histogram{
+					Sum:     1.25,
+					Buckets: map[float64]uint64{0.5: 3},
+				},
+			},
+		},
+		{
+			name: "le-string-bound",
+			row: map[string]bigquery.Value{
+				"le":    "+Inf",
+				"value": int64(7),
+			},
+			want: sql.Metric{
+				Histogram: &sql.Histogram{
+					Buckets: map[float64]uint64{math.Inf(1): 7},
+				},
+			},
+		},
+		{
+			name: "bucket-columns",
+			row: map[string]bigquery.Value{
+				"bucket_0_25": int64(1),
+				"bucket_10":   int64(4),
+				"bucket_inf":  int64(5),
+				"value_sum":   12.5,
+				"value_count": int64(5),
+			},
+			want: sql.Metric{
+				Histogram: &sql.Histogram{
+					Count:   5,
+					Sum:     12.5,
+					Buckets: map[float64]uint64{0.25: 1, 10: 4, math.Inf(1): 5},
+				},
+			},
+		},
+		{
+			name:    "error-no-buckets",
+			row:     map[string]bigquery.Value{"value_sum": 1.0},
+			wantErr: true,
+		},
+		{
+			name:    "error-le-without-value",
+			row:     map[string]bigquery.Value{"le": 1.0},
+			wantErr: true,
+		},
+		{
+			name:    "error-value-without-le",
+			row:     map[string]bigquery.Value{"bucket_1": int64(1), "value": int64(1)},
+			wantErr: true,
+		},
+		{
+			name:    "error-bad-bound",
+			row:     map[string]bigquery.Value{"le": true, "value": int64(1)},
+			wantErr: true,
+		},
+		{
+			name:    "error-bad-bucket-column",
+			row:     map[string]bigquery.Value{"bucket_x": int64(1)},
+			wantErr: true,
+		},
+		{
+			name:    "error-unsupported-value-column",
+			row:     map[string]bigquery.Value{"bucket_1": int64(1), "value_p50": 1.0},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := rowToHistogram(tt.row)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("rowToHistogram() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("rowToHistogram() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBQRunner_QueryHistograms(t *testing.T) {
+	qr := &BQRunner{
+		Histogram: true,
+		runner: &fakeQuery{
+			rows: []map[string]bigquery.Value{
+				{"site": "a", "le": 1.0, "value": int64(2), "value_sum": 3.5},
+				{"site": "a", "le": 5.0, "value": int64(6), "value_sum": 3.5},
+				{"site": "a", "le": "+Inf", "value": int64(7), "value_sum": 3.5},
+				{"site": "b", "le": 1.0, "value": int64(1)},
+				{"site": "b", "le": 5.0, "value": int64(4)},
+			},
+		},
+	}
+	got, err := qr.Query(context.Background(), "select * from `fake-table`")
+	if err != nil {
+		t.Fatalf("BQRunner.Query() error = %v", err)
+	}
+	want := []sql.Metric{
+		{
+			LabelKeys:   []string{"site"},
+			LabelValues: []string{"a"},
+			Histogram: &sql.Histogram{
+				Count:   7,
+				Sum:     3.5,
+				Buckets: map[float64]uint64{1: 2, 5: 6},
+			},
+		},
+		{
+			LabelKeys:   []string{"site"},
+			LabelValues: []string{"b"},
+			Histogram: &sql.Histogram{
+				Count:   4,
+				Buckets: map[float64]uint64{1: 1, 5: 4},
+			},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("BQRunner.Query() = %#v, want %#v", got, want)
+	}
+
+	qr.runner = &fakeQuery{rows: []map[string]bigquery.Value{{"value_sum": 1.0}}}
+	if _, err := qr.Query(context.Background(), "select * from `fake-table`"); err == nil {
+		t.Errorf("BQRunner.Query() expected error for invalid histogram row")
+	}
+}
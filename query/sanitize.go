@@ -0,0 +1,94 @@
+package query
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"cloud.google.com/go/bigquery"
+)
+
+// sanitizeName replaces every character of name that is not valid in a
+// prometheus label name with '_'. Metric name suffixes may also contain ':'.
+func sanitizeName(name string, colon bool) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_':
+			return r
+		case r == ':' && colon:
+			return r
+		default:
+			return '_'
+		}
+	}, name)
+}
+
+// sanitizeLabel converts a column name into a valid prometheus label name.
+// Names starting with a digit are prefixed with '_', and names starting with
+// the reserved prefix "__" are shortened to start with a single '_'.
+func sanitizeLabel(name string) string {
+	s := sanitizeName(name, false)
+	if s == "" || (s[0] >= '0' && s[0] <= '9') {
+		s = "_" + s
+	}
+	for strings.HasPrefix(s, "__") {
+		s = s[1:]
+	}
+	return s
+}
+
+// sanitizeColumn returns the sanitized name of column k of a result row.
+// Label columns are valid prometheus label names, and value columns create
+// valid prometheus metric names. All other columns are unchanged.
+func (qr *BQRunner) sanitizeColumn(k string) string {
+	switch {
+	case qr.isLabel(k):
+		return sanitizeLabel(k)
+	case len(qr.ValueColumns) == 0 && strings.HasPrefix(k, "value"):
+		return "value" + sanitizeName(strings.TrimPrefix(k, "value"), true)
+	default:
+		return k
+	}
+}
+
+// sanitizeRow returns a copy of row with sanitized column names, and with
+// invalid UTF-8 in string label values replaced by U+FFFD. If no column
+// changes, row is returned as-is. Columns whose sanitized names collide are
+// an error.
+func (qr *BQRunner) sanitizeRow(row map[string]bigquery.Value) (map[string]bigquery.Value, error) {
+	changed := false
+	for k, v := range row {
+		s, ok := v.(string)
+		if qr.sanitizeColumn(k) != k || (ok && qr.isLabel(k) && !utf8.ValidString(s)) {
+			changed = true
+			break
+		}
+	}
+	if !changed {
+		return row, nil
+	}
+	sanitized := make(map[string]bigquery.Value, len(row))
+	for k, v := range row {
+		name := qr.sanitizeColumn(k)
+		if _, ok := sanitized[name]; ok {
+			return nil, fmt.Errorf("column %q: duplicate sanitized column %q", k, name)
+		}
+		if s, ok := v.(string); ok && qr.isLabel(k) {
+			v = strings.ToValidUTF8(s, string(utf8.RuneError))
+		}
+		sanitized[name] = v
+	}
+	return sanitized, nil
+}
+
+// sanitize returns a visit function that sanitizes every row before passing
+// it to visit.
+func (qr *BQRunner) sanitize(visit func(row map[string]bigquery.Value) error) func(row map[string]bigquery.Value) error {
+	return func(row map[string]bigquery.Value) error {
+		r, err := qr.sanitizeRow(row)
+		if err != nil {
+			return err
+		}
+		return visit(r)
+	}
+}
@@ -0,0 +1,107 @@
+package query
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/m-lab/prometheus-bigquery-exporter/sql"
+)
+
+func TestSanitizeLabel(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{name: "site", want: "site"},
+		{name: "site-name", want: "site_name"},
+		{name: "machine.host", want: "machine_host"},
+		{name: "2020", want: "_2020"},
+		{name: "__name__", want: "_name__"},
+		{name: "ünïcode", want: "_n_code"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sanitizeLabel(tt.name); got != tt.want {
+				t.Errorf("sanitizeLabel() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBQRunner_sanitizeRow(t *testing.T) {
+	tests := []struct {
+		name    string
+		qr      *BQRunner
+		row     map[string]bigquery.Value
+		want    map[string]bigquery.Value
+		wantErr bool
+	}{
+		{
+			name: "unchanged",
+			qr:   &BQRunner{},
+			row:  map[string]bigquery.Value{"site": "a", "value_p50": 1.0},
+			want: map[string]bigquery.Value{"site": "a", "value_p50": 1.0},
+		},
+		{
+			name: "labels-and-values",
+			qr:   &BQRunner{},
+			row:  map[string]bigquery.Value{"__site": "a\xff", "value-p50": 1.0, "value:p90": 2.0},
+			want: map[string]bigquery.Value{"_site": "a�", "value_p50": 1.0, "value:p90": 2.0},
+		},
+		{
+			name: "histogram-columns-unchanged",
+			qr:   &BQRunner{Histogram: true},
+			row:  map[string]bigquery.Value{"site-name": "a", "bucket_0_5": int64(1)},
+			want: map[string]bigquery.Value{"site_name": "a", "bucket_0_5": int64(1)},
+		},
+		{
+			name: "declared-columns-unchanged",
+			qr:   &BQRunner{LabelColumns: []string{"site"}, ValueColumns: map[string]string{"tests-run": ""}},
+			row:  map[string]bigquery.Value{"site": "a", "tests-run": int64(1)},
+			want: map[string]bigquery.Value{"site": "a", "tests-run": int64(1)},
+		},
+		{
+			name:    "error-duplicate-sanitized-column",
+			qr:      &BQRunner{},
+			row:     map[string]bigquery.Value{"site-name": "a", "site_name": "b", "value": 1.0},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.qr.sanitizeRow(tt.row)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("BQRunner.sanitizeRow() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("BQRunner.sanitizeRow() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBQRunner_QuerySanitized(t *testing.T) {
+	qr := &BQRunner{
+		runner: &fakeQuery{
+			rows: []map[string]bigquery.Value{{"site-name": "a", "value": 1.0}},
+			schema: bigquery.Schema{
+				{Name: "site-name", Type: bigquery.StringFieldType},
+				{Name: "value", Type: bigquery.FloatFieldType},
+			},
+		},
+	}
+	got, err := qr.Query(context.Background(), "select * from `fake-table`")
+	if err != nil {
+		t.Fatalf("BQRunner.Query() error = %v", err)
+	}
+	want := []sql.Metric{sql.NewMetric([]string{"site_name"}, []string{"a"}, map[string]float64{"": 1})}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("BQRunner.Query() = %#v, want %#v", got, want)
+	}
+	if s := qr.Schema(); s == nil || !reflect.DeepEqual(s.LabelKeys, []string{"site_name"}) {
+		t.Errorf("BQRunner.Schema() = %#v, want label site_name", s)
+	}
+}
@@ -0,0 +1,97 @@
+package query
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/m-lab/prometheus-bigquery-exporter/sql"
+)
+
+// DefaultQuantiles are the quantiles reported for summary queries when no
+// quantiles are given.
+var DefaultQuantiles = []float64{0.5, 0.9, 0.99}
+
+// quantile returns the value of quantile q from approx, the result of
+// APPROX_QUANTILES(x, n), which holds n+1 values with approx[i] being the
+// approximate i/n quantile.
+func quantile(approx []float64, q float64) float64 {
+	if len(approx) == 0 {
+		return math.NaN()
+	}
+	return approx[int(math.Round(q*float64(len(approx)-1)))]
+}
+
+// rowToSummary converts a bigquery result row into a sql.Metric with a
+// Summary. The "value" column must be an ARRAY<FLOAT64> returned by
+// APPROX_QUANTILES, from which the given quantiles are reported. Rows may also
+// define "value_sum" and "value_count" columns. All other columns are labels.
+func rowToSummary(row map[string]bigquery.Value, quantiles []float64) (sql.Metric, error) {
+	s := &sql.Summary{Quantiles: make(map[float64]float64, len(quantiles))}
+	var labelKeys []string
+	var labelValues []string
+	var approx []float64
+	found := false
+
+	for k, v := range row {
+		switch {
+		case k == "value":
+			arr, ok := v.([]bigquery.Value)
+			if !ok {
+				return sql.Metric{}, fmt.Errorf("column %q must be an array, got %T", k, v)
+			}
+			for i := range arr {
+				approx = append(approx, valToFloat(arr[i]))
+			}
+			found = true
+		case k == sumColumn:
+			s.Sum = valToFloat(v)
+		case k == countColumn:
+			s.Count = toCount(valToFloat(v))
+		case strings.HasPrefix(k, "value"):
+			return sql.Metric{}, fmt.Errorf("unsupported summary column %q", k)
+		default:
+			labelKeys = append(labelKeys, k)
+		}
+	}
+	if !found {
+		return sql.Metric{}, fmt.Errorf("summary rows must define a %q column", "value")
+	}
+	for _, q := range quantiles {
+		s.Quantiles[q] = quantile(approx, q)
+	}
+	sort.Strings(labelKeys)
+	for i := range labelKeys {
+		labelValues = append(labelValues, valToString(row[labelKeys[i]]))
+	}
+	return sql.Metric{LabelKeys: labelKeys, LabelValues: labelValues, Summary: s}, nil
+}
+
+// quantiles returns the quantiles reported by summary queries.
+func (qr *BQRunner) quantiles() []float64 {
+	if len(qr.Quantiles) == 0 {
+		return DefaultQuantiles
+	}
+	return qr.Quantiles
+}
+
+// querySummaries runs the query and converts every result row into a summary.
+func (qr *BQRunner) querySummaries(ctx context.Context, query string) ([]sql.Metric, error) {
+	quantiles := qr.quantiles()
+	metrics := []sql.Metric{}
+	err := qr.run(ctx, query, func(row map[string]bigquery.Value) error {
+		m, err := rowToSummary(row, quantiles)
+		if err != nil {
+			return err
+		}
+		metrics = append(metrics, m)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return metrics, nil
+}
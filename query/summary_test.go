@@ -0,0 +1,118 @@
+package query
+
+import (
+	"context"
+	"math"
+	"reflect"
+	"testing"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/m-lab/prometheus-bigquery-exporter/sql"
+)
+
+// approxQuantiles returns the result of APPROX_QUANTILES(x, 100) for x from 0
+// to 1000.
+func approxQuantiles() []bigquery.Value {
+	r := []bigquery.Value{}
+	for i := 0; i <= 100; i++ {
+		r = append(r, float64(i*10))
+	}
+	return r
+}
+
+func TestRowToSummary(t *testing.T) {
+	tests := []struct {
+		name      string
+		row       map[string]bigquery.Value
+		quantiles []float64
+		want      sql.Metric
+		wantErr   bool
+	}{
+		{
+			name: "success",
+			row: map[string]bigquery.Value{
+				"site":        "foo01",
+				"value":       approxQuantiles(),
+				"value_sum":   5000.0,
+				"value_count": int64(11),
+			},
+			quantiles: []float64{0, 0.5, 0.99, 1},
+			want: sql.Metric{
+				LabelKeys:   []string{"site"},
+				LabelValues: []string{"foo01"},
+				Summary: &sql.Summary{
+					Count:     11,
+					Sum:       5000,
+					Quantiles: map[float64]float64{0: 0, 0.5: 500, 0.99: 990, 1: 1000},
+				},
+			},
+		},
+		{
+			name: "success-fewer-quantiles",
+			row: map[string]bigquery.Value{
+				"value": []bigquery.Value{int64(1), int64(5), int64(9)},
+			},
+			quantiles: []float64{0.5, 0.9},
+			want: sql.Metric{
+				Summary: &sql.Summary{
+					Quantiles: map[float64]float64{0.5: 5, 0.9: 9},
+				},
+			},
+		},
+		{
+			name:    "error-missing-value",
+			row:     map[string]bigquery.Value{"value_sum": 1.0},
+			wantErr: true,
+		},
+		{
+			name:    "error-value-not-array",
+			row:     map[string]bigquery.Value{"value": 1.0},
+			wantErr: true,
+		},
+		{
+			name:    "error-unsupported-value-column",
+			row:     map[string]bigquery.Value{"value": approxQuantiles(), "value_p50": 1.0},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := rowToSummary(tt.row, tt.quantiles)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("rowToSummary() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("rowToSummary() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBQRunner_QuerySummaries(t *testing.T) {
+	qr := &BQRunner{
+		Summary: true,
+		runner: &fakeQuery{
+			rows: []map[string]bigquery.Value{
+				{"value": approxQuantiles()},
+				{"value": []bigquery.Value{}},
+			},
+		},
+	}
+	got, err := qr.Query(context.Background(), "select * from `fake-table`")
+	if err != nil {
+		t.Fatalf("BQRunner.Query() error = %v", err)
+	}
+	want := map[float64]float64{0.5: 500, 0.9: 900, 0.99: 990}
+	if len(got) != 2 || !reflect.DeepEqual(got[0].Summary.Quantiles, want) {
+		t.Errorf("BQRunner.Query() = %#v, want quantiles %v", got, want)
+	}
+	if !math.IsNaN(got[1].Summary.Quantiles[0.5]) {
+		t.Errorf("BQRunner.Query() empty quantiles = %v, want NaN", got[1].Summary.Quantiles)
+	}
+
+	qr.runner = &fakeQuery{rows: []map[string]bigquery.Value{{"value": 1.0}}}
+	if _, err := qr.Query(context.Background(), "select * from `fake-table`"); err == nil {
+		t.Errorf("BQRunner.Query() expected error for invalid summary row")
+	}
+}
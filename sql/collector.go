@@ -2,11 +2,17 @@
 package sql
 
 import (
+	"context"
+	"fmt"
 	"log"
+	"regexp"
+	"strings"
 	"sync"
 	"time"
+	"unicode/utf8"
 
 	"github.com/m-lab/go/logx"
+	"github.com/m-lab/prometheus-bigquery-exporter/internal/metrics"
 
 	"github.com/prometheus/client_golang/prometheus"
 )
@@ -16,6 +22,26 @@ type Metric struct {
 	LabelKeys   []string
 	LabelValues []string
 	Values      map[string]float64
+	// Histogram is set instead of Values for histogram query results.
+	Histogram *Histogram
+	// Summary is set instead of Values for summary query results.
+	Summary *Summary
+}
+
+// Histogram holds the cumulative bucket counts, total count and sum of
+// observations for a single histogram.
+type Histogram struct {
+	Count   uint64
+	Sum     float64
+	Buckets map[float64]uint64
+}
+
+// Summary holds the quantiles, total count and sum of observations for a
+// single summary.
+type Summary struct {
+	Count     uint64
+	Sum       float64
+	Quantiles map[float64]float64
 }
 
 // NewMetric creates a Metric with given values.
@@ -28,8 +54,26 @@ func NewMetric(labelKeys []string, labelValues []string, values map[string]float
 }
 
 // QueryRunner defines the interface used to run a query and return an array of metrics.
+// Query should stop and return an error when the context is done.
 type QueryRunner interface {
-	Query(q string) ([]Metric, error)
+	Query(ctx context.Context, q string) ([]Metric, error)
+}
+
+// SchemaRunner is an optional interface for a QueryRunner that can describe
+// the results of its last query, even when the query returned no rows.
+type SchemaRunner interface {
+	// Schema returns a Metric with the label keys and value names of the last
+	// query results, or nil if they are unknown.
+	Schema() *Metric
+}
+
+// RowCountRunner is an optional interface for a QueryRunner that can report
+// the number of rows returned by its last query, which may differ from the
+// number of metrics created from them.
+type RowCountRunner interface {
+	// RowCount returns the number of rows returned by the last successful
+	// query.
+	RowCount() int
 }
 
 // Collector manages a prometheus.Collector for queries performed by a QueryRunner.
@@ -44,20 +88,52 @@ type Collector struct {
 	// valType defines whether the metric is a Gauge or Counter type.
 	valType prometheus.ValueType
 	// descs maps metric suffixes to the prometheus description. These descriptions
-	// are generated once and must be stable over time.
+	// are generated once, from the first results or schema that describe them,
+	// and must be stable over time.
 	descs map[string]*prometheus.Desc
+	// labelKeys are the label names of descs.
+	labelKeys []string
 
 	// metrics caches the last set of collected results from a query.
 	metrics []Metric
+	// rows is the number of rows returned by the query for metrics.
+	rows int
+	// updated is true once Update has been called.
+	updated bool
+	// counters holds the state of every counter series for counter queries.
+	counters map[string]*counter
+	// updates is the number of results accumulated into counters.
+	updates int
 	// mux locks access to types above.
 	mux sync.Mutex
 
-	// RegisterErr contains any error during registration. This should be considered fatal.
+	// RegisterErr contains any error from the query run during registration.
 	RegisterErr error
+
+	// Help is the help text for all metrics created by this collector. Help,
+	// ValueHelp and ConstLabels must be set before the collector is registered.
+	Help string
+	// ValueHelp maps metric suffixes to help text that overrides Help.
+	ValueHelp map[string]string
+	// ConstLabels are added to all metrics created by this collector.
+	ConstLabels prometheus.Labels
+	// CounterPolicy defines how query values are converted to counter values
+	// when the collector valType is prometheus.CounterValue.
+	CounterPolicy CounterPolicy
+	// DuplicatePolicy defines how metrics with the same label values in the
+	// results of a single query are resolved.
+	DuplicatePolicy DuplicatePolicy
+	// Unchecked collectors report no descriptions, so they are registered as
+	// unchecked collectors. Describe never runs the query, and descriptions
+	// are recreated from the results of every Update, so the labels and
+	// values of the query may change between updates.
+	Unchecked bool
 }
 
 // NewCollector creates a new BigQuery Collector instance.
 func NewCollector(runner QueryRunner, valType prometheus.ValueType, metricName, query string) *Collector {
+	// Initialize the error count so that it is reported before any error.
+	metrics.QueryErrors.WithLabelValues(metricName)
 	return &Collector{
 		runner:     runner,
 		metricName: metricName,
@@ -70,21 +146,29 @@ func NewCollector(runner QueryRunner, valType prometheus.ValueType, metricName,
 }
 
 // Describe satisfies the prometheus.Collector interface. Describe is called
-// immediately after registering the collector.
+// immediately after registering the collector. If the collector was never
+// updated, Describe runs the query to find the descriptions.
 func (col *Collector) Describe(ch chan<- *prometheus.Desc) {
 	logx.Debug.Println("Describe:", time.Now())
-	if col.descs == nil {
-		// TODO: collect metrics for query exec time.
-		col.descs = make(map[string]*prometheus.Desc, 1)
-		err := col.Update()
+	if col.Unchecked {
+		return
+	}
+	col.mux.Lock()
+	descs, updated := col.descs, col.updated
+	col.mux.Unlock()
+	if !updated {
+		err := col.Update(context.Background())
 		if err != nil {
 			log.Println(err)
 			col.RegisterErr = err
 		}
-		col.setDesc()
+		col.mux.Lock()
+		descs = col.descs
+		col.mux.Unlock()
 	}
-	// NOTE: if Update returns no metrics, this will fail.
-	for _, desc := range col.descs {
+	// NOTE: if the query returns no rows and the runner cannot describe the
+	// results, there are no descriptions until the query returns rows.
+	for _, desc := range descs {
 		ch <- desc
 	}
 }
@@ -94,49 +178,216 @@ func (col *Collector) Describe(ch chan<- *prometheus.Desc) {
 func (col *Collector) Collect(ch chan<- prometheus.Metric) {
 	logx.Debug.Println("Collect:", time.Now())
 	col.mux.Lock()
-	// Get reference to current metrics slice to allow Update to run concurrently.
+	// Get reference to current metrics slice and descriptions to allow Update
+	// to run concurrently.
 	metrics := col.metrics
+	descs := col.descs
 	col.mux.Unlock()
 
-	for i := range col.metrics {
-		for k, desc := range col.descs {
+	for i := range metrics {
+		if h := metrics[i].Histogram; h != nil {
+			if desc, ok := descs[""]; ok {
+				col.send(ch, func() (prometheus.Metric, error) {
+					return prometheus.NewConstHistogram(
+						desc, h.Count, h.Sum, h.Buckets, metrics[i].LabelValues...)
+				})
+			}
+			continue
+		}
+		if s := metrics[i].Summary; s != nil {
+			if desc, ok := descs[""]; ok {
+				col.send(ch, func() (prometheus.Metric, error) {
+					return prometheus.NewConstSummary(
+						desc, s.Count, s.Sum, s.Quantiles, metrics[i].LabelValues...)
+				})
+			}
+			continue
+		}
+		for k, desc := range descs {
 			logx.Debug.Printf("%s labels:%#v values:%#v",
 				col.metricName, metrics[i].LabelValues, metrics[i].Values[k])
-			ch <- prometheus.MustNewConstMetric(
-				desc, col.valType, metrics[i].Values[k], metrics[i].LabelValues...)
+			col.send(ch, func() (prometheus.Metric, error) {
+				return prometheus.NewConstMetric(
+					desc, col.valType, metrics[i].Values[k], metrics[i].LabelValues...)
+			})
 		}
 	}
 }
 
+// send sends the metric created by newMetric to ch. Metrics that cannot be
+// created, e.g. because of invalid labels, are logged and skipped, so that
+// they do not fail the collection of all other metrics.
+func (col *Collector) send(ch chan<- prometheus.Metric, newMetric func() (prometheus.Metric, error)) {
+	m, err := newMetric()
+	if err != nil {
+		log.Println(col.metricName, "failed to create metric:", err)
+		return
+	}
+	ch <- m
+}
+
 // String satisfies the Stringer interface. String returns the metric name.
 func (col *Collector) String() string {
 	return col.metricName
 }
 
-// Update runs the collector query and atomically updates the cached metrics.
-// Update is called automaticlly after the collector is registered.
-func (col *Collector) Update() error {
-	logx.Debug.Println("Update:", col.metricName)
-	metrics, err := col.runner.Query(col.query)
+// Update runs the collector query, atomically updates the cached metrics and
+// records the successful query run. Update is called automaticlly after the
+// collector is registered.
+func (col *Collector) Update(ctx context.Context) error {
+	err := col.Load(ctx)
+	if err != nil {
+		return err
+	}
+	col.RecordSuccess()
+	return nil
+}
+
+// RecordSuccess reports the number of rows and the time of the last
+// successful Load. RecordSuccess should only be called for collectors that
+// are registered, so that a collector that failed to register does not hide
+// the staleness of the collector that is served instead.
+func (col *Collector) RecordSuccess() {
+	col.mux.Lock()
+	n := col.rows
+	col.mux.Unlock()
+	metrics.QueryRows.WithLabelValues(col.metricName).Set(float64(n))
+	metrics.QueryLastSuccess.WithLabelValues(col.metricName).SetToCurrentTime()
+}
+
+// Load runs the collector query and atomically updates the cached metrics,
+// without recording the successful query run.
+func (col *Collector) Load(ctx context.Context) error {
+	logx.Debug.Println("Load:", col.metricName)
+	col.mux.Lock()
+	col.updated = true
+	col.mux.Unlock()
+	start := time.Now()
+	results, err := col.runner.Query(ctx, col.query)
+	metrics.QueryDuration.WithLabelValues(col.metricName).Observe(time.Since(start).Seconds())
+	// Runners that cannot count rows return one metric per row.
+	rows := len(results)
+	if r, ok := col.runner.(RowCountRunner); ok {
+		rows = r.RowCount()
+	}
+	if err == nil {
+		err = col.checkLabels(results)
+	}
+	if err == nil {
+		results, err = col.dedupe(results)
+	}
 	if err != nil {
 		logx.Debug.Println("Failed to run query:", err)
+		metrics.QueryErrors.WithLabelValues(col.metricName).Inc()
 		return err
 	}
 	// Swap the cached metrics.
 	col.mux.Lock()
 	defer col.mux.Unlock()
+	if col.valType == prometheus.CounterValue {
+		results = col.accumulate(results)
+	}
 	// Replace slice reference with new value returned from Query. References
 	// to the previous value of col.metrics are not affected.
-	col.metrics = metrics
+	col.metrics = results
+	col.rows = rows
+	// Descriptions are created once, from the first results that describe them,
+	// unless the collector is unchecked.
+	if col.Unchecked || len(col.descs) == 0 {
+		col.setDesc()
+	}
 	return nil
 }
 
+// setDesc creates the metric descriptions from the cached metrics, or from the
+// runner schema if the query returned no rows. The caller must hold col.mux.
 func (col *Collector) setDesc() {
-	// The query may return no results.
+	m := col.schema()
+	if m == nil {
+		return
+	}
+	descs := make(map[string]*prometheus.Desc, len(m.Values))
+	if m.Histogram != nil || m.Summary != nil {
+		descs[""] = prometheus.NewDesc(col.metricName, col.help(""), m.LabelKeys, col.ConstLabels)
+	}
+	for k := range m.Values {
+		descs[k] = prometheus.NewDesc(col.metricName+k, col.help(k), m.LabelKeys, col.ConstLabels)
+	}
+	col.descs = descs
+	col.labelKeys = m.LabelKeys
+}
+
+// schema returns a metric describing the labels and values of the query
+// results, or nil if they are unknown.
+func (col *Collector) schema() *Metric {
 	if len(col.metrics) > 0 {
-		for k := range col.metrics[0].Values {
-			// TODO: allow passing meaningful help text.
-			col.descs[k] = prometheus.NewDesc(col.metricName+k, "help text", col.metrics[0].LabelKeys, nil)
+		return &col.metrics[0]
+	}
+	if r, ok := col.runner.(SchemaRunner); ok {
+		return r.Schema()
+	}
+	return nil
+}
+
+// help returns the help text for the metric with the given suffix.
+func (col *Collector) help(suffix string) string {
+	if h := col.ValueHelp[suffix]; h != "" {
+		return h
+	}
+	if col.Help != "" {
+		return col.Help
+	}
+	return "help text"
+}
+
+// labelName matches valid prometheus label names.
+var labelName = regexp.MustCompile("^[a-zA-Z_][a-zA-Z0-9_]*$")
+
+// equalKeys returns true if a and b hold the same label names.
+func equalKeys(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// checkLabels verifies that the label names of the query results are valid
+// and do not use the name of a constant label, that every result has the same
+// label names as the descriptions, and that all label values are valid UTF-8.
+// Results that fail these checks would otherwise fail when collected.
+func (col *Collector) checkLabels(metrics []Metric) error {
+	if len(metrics) == 0 {
+		return nil
+	}
+	keys := metrics[0].LabelKeys
+	for _, k := range keys {
+		if !labelName.MatchString(k) || strings.HasPrefix(k, "__") {
+			return fmt.Errorf("%s: invalid label name %q", col.metricName, k)
 		}
+		if _, ok := col.ConstLabels[k]; ok {
+			return fmt.Errorf("%s: label column %q conflicts with a constant label", col.metricName, k)
+		}
+	}
+	col.mux.Lock()
+	described, descKeys := col.descs != nil && !col.Unchecked, col.labelKeys
+	col.mux.Unlock()
+	if described && !equalKeys(keys, descKeys) {
+		return fmt.Errorf("%s: labels %q differ from registered labels %q", col.metricName, keys, descKeys)
 	}
+	for _, m := range metrics {
+		if !equalKeys(m.LabelKeys, keys) || len(m.LabelValues) != len(keys) {
+			return fmt.Errorf("%s: inconsistent labels %q", col.metricName, m.LabelKeys)
+		}
+		for _, v := range m.LabelValues {
+			if !utf8.ValidString(v) {
+				return fmt.Errorf("%s: invalid UTF-8 label value %q", col.metricName, v)
+			}
+		}
+	}
+	return nil
 }
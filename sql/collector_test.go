@@ -1,6 +1,7 @@
 package sql
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"log"
@@ -11,22 +12,34 @@ import (
 
 	"github.com/m-lab/go/prometheusx"
 	"github.com/m-lab/go/prometheusx/promtest"
+	"github.com/m-lab/prometheus-bigquery-exporter/internal/metrics"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 type fakeQueryRunner struct {
 	metrics []Metric
 }
 
-func (qr *fakeQueryRunner) Query(query string) ([]Metric, error) {
+func (qr *fakeQueryRunner) Query(ctx context.Context, query string) ([]Metric, error) {
 	return qr.metrics, nil
 }
 
+// schemaQueryRunner returns the given metrics and describes them by schema.
+type schemaQueryRunner struct {
+	fakeQueryRunner
+	schema *Metric
+}
+
+func (qr *schemaQueryRunner) Schema() *Metric {
+	return qr.schema
+}
+
 type errorQueryRunner struct {
 	count int
 }
 
-func (qr *errorQueryRunner) Query(query string) ([]Metric, error) {
+func (qr *errorQueryRunner) Query(ctx context.Context, query string) ([]Metric, error) {
 	qr.count++
 	return nil, fmt.Errorf("Fake query error")
 }
@@ -120,6 +133,122 @@ func TestNewCollector(t *testing.T) {
 	if r.count != 1 {
 		t.Errorf("NewCollector() expected an error on Register")
 	}
+	if v := testutil.ToFloat64(metrics.QueryErrors.WithLabelValues("metric_name")); v != 1 {
+		t.Errorf("bqx_query_errors_total = %v, want 1", v)
+	}
+}
+
+func TestCollector_UpdateMetrics(t *testing.T) {
+	c := NewCollector(&fakeQueryRunner{[]Metric{
+		NewMetric([]string{"key"}, []string{"a"}, map[string]float64{"": 1}),
+		NewMetric([]string{"key"}, []string{"b"}, map[string]float64{"": 2}),
+	}}, prometheus.GaugeValue, "update_metrics", "")
+	if err := c.Update(context.Background()); err != nil {
+		t.Fatalf("Update() error = %v", err)
+	}
+	if v := testutil.ToFloat64(metrics.QueryRows.WithLabelValues("update_metrics")); v != 2 {
+		t.Errorf("bqx_query_rows = %v, want 2", v)
+	}
+	if v := testutil.ToFloat64(metrics.QueryLastSuccess.WithLabelValues("update_metrics")); v == 0 {
+		t.Errorf("bqx_query_last_success_timestamp_seconds = %v, want non-zero", v)
+	}
+	if v := testutil.ToFloat64(metrics.QueryErrors.WithLabelValues("update_metrics")); v != 0 {
+		t.Errorf("bqx_query_errors_total = %v, want 0", v)
+	}
+}
+
+// rowCountQueryRunner reports a row count for the results of fakeQueryRunner.
+type rowCountQueryRunner struct {
+	fakeQueryRunner
+	rows int
+}
+
+func (r *rowCountQueryRunner) RowCount() int {
+	return r.rows
+}
+
+func TestCollector_UpdateRowCount(t *testing.T) {
+	r := &rowCountQueryRunner{
+		fakeQueryRunner: fakeQueryRunner{[]Metric{
+			NewMetric([]string{"key"}, []string{"a"}, map[string]float64{"": 1}),
+		}},
+		rows: 3,
+	}
+	c := NewCollector(r, prometheus.GaugeValue, "update_row_count", "")
+	if err := c.Update(context.Background()); err != nil {
+		t.Fatalf("Update() error = %v", err)
+	}
+	if v := testutil.ToFloat64(metrics.QueryRows.WithLabelValues("update_row_count")); v != 3 {
+		t.Errorf("bqx_query_rows = %v, want 3", v)
+	}
+}
+
+// countDescs returns the number of descriptions and metrics reported by c.
+func countDescs(c *Collector) (int, int) {
+	chDesc := make(chan *prometheus.Desc, 10)
+	chCol := make(chan prometheus.Metric, 10)
+	c.Describe(chDesc)
+	c.Collect(chCol)
+	return len(chDesc), len(chCol)
+}
+
+func TestCollector_NoRows(t *testing.T) {
+	rows := []Metric{NewMetric([]string{"key"}, []string{"a"}, map[string]float64{"": 1})}
+	tests := []struct {
+		name  string
+		r     *schemaQueryRunner
+		descs int
+	}{
+		{
+			name:  "with-schema",
+			r:     &schemaQueryRunner{schema: &rows[0]},
+			descs: 1,
+		},
+		{
+			name: "without-schema",
+			r:    &schemaQueryRunner{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewCollector(tt.r, prometheus.GaugeValue, "no_rows", "")
+			if d, m := countDescs(c); d != tt.descs || m != 0 {
+				t.Errorf("Collector with no rows got %d descs %d metrics, want %d and 0", d, m, tt.descs)
+			}
+			// Descriptions are available once the query returns rows.
+			tt.r.metrics = rows
+			if err := c.Update(context.Background()); err != nil {
+				t.Fatalf("Update() error = %v", err)
+			}
+			if d, m := countDescs(c); d != 1 || m != 1 {
+				t.Errorf("Collector with rows got %d descs %d metrics, want 1 and 1", d, m)
+			}
+		})
+	}
+}
+
+func TestCollector_Unchecked(t *testing.T) {
+	r := &fakeQueryRunner{[]Metric{NewMetric(nil, nil, map[string]float64{"": 1})}}
+	c := NewCollector(r, prometheus.GaugeValue, "unchecked", "")
+	c.Unchecked = true
+	// Describe does not run the query.
+	if d, m := countDescs(c); d != 0 || m != 0 {
+		t.Errorf("unchecked Collector got %d descs %d metrics, want 0 and 0", d, m)
+	}
+	if err := c.Update(context.Background()); err != nil {
+		t.Fatalf("Update() error = %v", err)
+	}
+	if d, m := countDescs(c); d != 0 || m != 1 {
+		t.Errorf("unchecked Collector got %d descs %d metrics, want 0 and 1", d, m)
+	}
+	// Labels and values may change between updates.
+	r.metrics = []Metric{NewMetric([]string{"key"}, []string{"a"}, map[string]float64{"_a": 1, "_b": 2})}
+	if err := c.Update(context.Background()); err != nil {
+		t.Fatalf("Update() error = %v", err)
+	}
+	if _, m := countDescs(c); m != 2 {
+		t.Errorf("unchecked Collector got %d metrics, want 2", m)
+	}
 }
 
 func TestNewMetric(t *testing.T) {
@@ -133,3 +262,203 @@ func TestNewMetric(t *testing.T) {
 		t.Errorf("NewMetric() = %v, want %v", m, want)
 	}
 }
+
+func TestCollector_Histogram(t *testing.T) {
+	metrics := []Metric{
+		{
+			LabelKeys:   []string{"key"},
+			LabelValues: []string{"thing"},
+			Histogram: &Histogram{
+				Count:   7,
+				Sum:     3.5,
+				Buckets: map[float64]uint64{1: 2, 5: 6},
+			},
+		},
+	}
+	c := NewCollector(
+		&fakeQueryRunner{metrics}, prometheus.UntypedValue, "fake_histogram", "-- not used")
+	reg := prometheus.NewRegistry()
+	if err := reg.Register(c); err != nil {
+		t.Fatalf("could not register collector: %v", err)
+	}
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("Gather() error = %v", err)
+	}
+	if len(mfs) != 1 || mfs[0].GetName() != "fake_histogram" {
+		t.Fatalf("Gather() got %v, want one fake_histogram metric family", mfs)
+	}
+	h := mfs[0].GetMetric()[0].GetHistogram()
+	if h.GetSampleCount() != 7 || h.GetSampleSum() != 3.5 || len(h.GetBucket()) != 2 {
+		t.Errorf("Gather() got histogram %v", h)
+	}
+}
+
+func TestCollector_Summary(t *testing.T) {
+	metrics := []Metric{
+		{
+			LabelKeys:   []string{"key"},
+			LabelValues: []string{"thing"},
+			Summary: &Summary{
+				Count:     10,
+				Sum:       55,
+				Quantiles: map[float64]float64{0.5: 5, 0.9: 9},
+			},
+		},
+	}
+	c := NewCollector(
+		&fakeQueryRunner{metrics}, prometheus.UntypedValue, "fake_summary", "-- not used")
+	reg := prometheus.NewRegistry()
+	if err := reg.Register(c); err != nil {
+		t.Fatalf("could not register collector: %v", err)
+	}
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("Gather() error = %v", err)
+	}
+	if len(mfs) != 1 || mfs[0].GetName() != "fake_summary" {
+		t.Fatalf("Gather() got %v, want one fake_summary metric family", mfs)
+	}
+	s := mfs[0].GetMetric()[0].GetSummary()
+	if s.GetSampleCount() != 10 || s.GetSampleSum() != 55 || len(s.GetQuantile()) != 2 {
+		t.Errorf("Gather() got summary %v", s)
+	}
+}
+
+func TestCollector_Help(t *testing.T) {
+	metrics := []Metric{
+		NewMetric(nil, nil, map[string]float64{"": 1, "_bytes": 2, "_other": 3}),
+	}
+	c := NewCollector(
+		&fakeQueryRunner{metrics}, prometheus.GaugeValue, "fake_metric", "-- not used")
+	c.Help = "Widgets."
+	c.ValueHelp = map[string]string{"_bytes": "Size of widgets."}
+	reg := prometheus.NewRegistry()
+	if err := reg.Register(c); err != nil {
+		t.Fatalf("could not register collector: %v", err)
+	}
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("Gather() error = %v", err)
+	}
+	want := map[string]string{
+		"fake_metric":       "Widgets.",
+		"fake_metric_bytes": "Size of widgets.",
+		"fake_metric_other": "Widgets.",
+	}
+	got := map[string]string{}
+	for _, mf := range mfs {
+		got[mf.GetName()] = mf.GetHelp()
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Gather() help = %v, want %v", got, want)
+	}
+}
+
+func TestCollector_ConstLabels(t *testing.T) {
+	metrics := []Metric{
+		NewMetric([]string{"key"}, []string{"thing"}, map[string]float64{"": 1}),
+	}
+	c := NewCollector(
+		&fakeQueryRunner{metrics}, prometheus.GaugeValue, "fake_metric", "-- not used")
+	c.ConstLabels = prometheus.Labels{"team": "widgets"}
+	reg := prometheus.NewRegistry()
+	if err := reg.Register(c); err != nil {
+		t.Fatalf("could not register collector: %v", err)
+	}
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("Gather() error = %v", err)
+	}
+	got := map[string]string{}
+	for _, l := range mfs[0].GetMetric()[0].GetLabel() {
+		got[l.GetName()] = l.GetValue()
+	}
+	want := map[string]string{"key": "thing", "team": "widgets"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Gather() labels = %v, want %v", got, want)
+	}
+
+	// A label column with the same name as a constant label is an error.
+	c.ConstLabels = prometheus.Labels{"key": "other"}
+	if err := c.Update(context.Background()); err == nil {
+		t.Errorf("Update() expected error for conflicting label column")
+	}
+}
+
+func TestCollector_checkLabels(t *testing.T) {
+	tests := []struct {
+		name    string
+		metrics []Metric
+		wantErr bool
+	}{
+		{
+			name: "success",
+			metrics: []Metric{
+				NewMetric([]string{"key"}, []string{"a"}, map[string]float64{"": 1}),
+				NewMetric([]string{"key"}, []string{"b"}, map[string]float64{"": 2}),
+			},
+		},
+		{
+			name:    "no-results",
+			metrics: []Metric{},
+		},
+		{
+			name:    "error-invalid-label-name",
+			metrics: []Metric{NewMetric([]string{"a-b"}, []string{"a"}, map[string]float64{"": 1})},
+			wantErr: true,
+		},
+		{
+			name:    "error-reserved-label-name",
+			metrics: []Metric{NewMetric([]string{"__key"}, []string{"a"}, map[string]float64{"": 1})},
+			wantErr: true,
+		},
+		{
+			name: "error-inconsistent-labels",
+			metrics: []Metric{
+				NewMetric([]string{"key"}, []string{"a"}, map[string]float64{"": 1}),
+				NewMetric([]string{"other"}, []string{"b"}, map[string]float64{"": 2}),
+			},
+			wantErr: true,
+		},
+		{
+			name:    "error-missing-label-values",
+			metrics: []Metric{NewMetric([]string{"key", "other"}, []string{"a"}, map[string]float64{"": 1})},
+			wantErr: true,
+		},
+		{
+			name:    "error-invalid-utf8",
+			metrics: []Metric{NewMetric([]string{"key"}, []string{"a\xff"}, map[string]float64{"": 1})},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewCollector(&fakeQueryRunner{tt.metrics}, prometheus.GaugeValue, "check_labels", "")
+			if err := c.checkLabels(tt.metrics); (err != nil) != tt.wantErr {
+				t.Errorf("Collector.checkLabels() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCollector_ChangedLabels(t *testing.T) {
+	r := &fakeQueryRunner{[]Metric{NewMetric([]string{"key"}, []string{"a"}, map[string]float64{"": 1})}}
+	c := NewCollector(r, prometheus.GaugeValue, "changed_labels", "")
+	if err := c.Update(context.Background()); err != nil {
+		t.Fatalf("Update() error = %v", err)
+	}
+	r.metrics = []Metric{NewMetric([]string{"other"}, []string{"a"}, map[string]float64{"": 1})}
+	if err := c.Update(context.Background()); err == nil {
+		t.Errorf("Update() expected error for changed labels")
+	}
+	if d, m := countDescs(c); d != 1 || m != 1 {
+		t.Errorf("Collector got %d descs %d metrics, want 1 and 1", d, m)
+	}
+
+	// Metrics that cannot be created are skipped instead of panicking.
+	c.metrics = []Metric{NewMetric([]string{"key"}, []string{"a\xff"}, map[string]float64{"": 1})}
+	if _, m := countDescs(c); m != 0 {
+		t.Errorf("Collector got %d metrics, want 0 for invalid label value", m)
+	}
+}
@@ -0,0 +1,114 @@
+package sql
+
+import (
+	"math"
+	"strings"
+)
+
+// CounterPolicy defines how query values are converted into monotonic counter
+// values.
+type CounterPolicy int
+
+const (
+	// CounterTotal treats query values as running totals. When a total
+	// decreases, the source is assumed to have reset and the counter continues
+	// to increase from its previous value.
+	CounterTotal CounterPolicy = iota
+	// CounterDelta treats query values as increments since the previous query,
+	// which are added to the counter. Negative increments are ignored.
+	CounterDelta
+	// CounterMax treats query values as running totals and ignores decreases.
+	// The counter keeps its maximum value until the total exceeds it again.
+	CounterMax
+)
+
+// maxMissedUpdates is the number of consecutive updates that a counter
+// series may be missing from the query results before its state is removed,
+// so that rotating label values do not grow memory without bound. A series
+// that returns after it was removed starts again as a new counter.
+const maxMissedUpdates = 10
+
+// counter holds the state of a single counter series between updates.
+type counter struct {
+	// last is the last value returned by the query.
+	last float64
+	// total is the monotonic value reported for the series.
+	total float64
+	// seen is the last update in which the series was in the query results.
+	seen int
+}
+
+// next updates the counter state with the query value v according to policy.
+// The first value of a new counter is reported unchanged.
+func (c *counter) next(v float64, policy CounterPolicy, isNew bool) {
+	switch {
+	case isNew:
+		c.total = math.Max(v, 0)
+	case policy == CounterDelta:
+		if v > 0 {
+			c.total += v
+		}
+	case policy == CounterMax:
+		c.total = math.Max(c.total, v)
+	case v >= c.last:
+		c.total += v - c.last
+	default:
+		// The running total was reset.
+		c.total += math.Max(v, 0)
+	}
+	c.last = v
+}
+
+// counterKey returns a unique key for the series identified by labelValues
+// and the metric suffix.
+func counterKey(labelValues []string, suffix string) string {
+	return strings.Join(labelValues, "\xff") + "\xff" + suffix
+}
+
+// accumulate converts the query values in metrics into counter values, and
+// returns a new slice of metrics with those values. The state of every counter
+// is kept across calls, so that a series missing from one result continues
+// from its previous value when it returns. The state of a series missing for
+// more than maxMissedUpdates calls is removed. NaN query values leave the
+// counter unchanged, and are dropped for series without counter state, so that
+// counters never report NaN.
+func (col *Collector) accumulate(metrics []Metric) []Metric {
+	if col.counters == nil {
+		col.counters = map[string]*counter{}
+	}
+	col.updates++
+	result := make([]Metric, 0, len(metrics))
+	for _, m := range metrics {
+		values := make(map[string]float64, len(m.Values))
+		for k, v := range m.Values {
+			key := counterKey(m.LabelValues, k)
+			c, ok := col.counters[key]
+			if math.IsNaN(v) {
+				// NaN values cannot contribute to a counter.
+				if ok {
+					c.seen = col.updates
+					values[k] = c.total
+				}
+				continue
+			}
+			if !ok {
+				c = &counter{}
+				col.counters[key] = c
+			}
+			c.next(v, col.CounterPolicy, !ok)
+			c.seen = col.updates
+			values[k] = c.total
+		}
+		if len(values) == 0 && len(m.Values) > 0 {
+			// Every value was NaN for a new series.
+			continue
+		}
+		result = append(result, NewMetric(m.LabelKeys, m.LabelValues, values))
+	}
+	for key, c := range col.counters {
+		if col.updates-c.seen > maxMissedUpdates {
+			delete(col.counters, key)
+		}
+	}
+	return result
+}
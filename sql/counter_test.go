@@ -0,0 +1,165 @@
+package sql
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// sequenceQueryRunner returns the next result from results on every query.
+type sequenceQueryRunner struct {
+	results [][]Metric
+	count   int
+}
+
+func (qr *sequenceQueryRunner) Query(ctx context.Context, query string) ([]Metric, error) {
+	m := qr.results[qr.count]
+	qr.count++
+	return m, nil
+}
+
+func values(vals ...float64) [][]Metric {
+	r := [][]Metric{}
+	for _, v := range vals {
+		r = append(r, []Metric{NewMetric([]string{"key"}, []string{"a"}, map[string]float64{"": v})})
+	}
+	return r
+}
+
+func TestCollector_accumulate(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  CounterPolicy
+		valType prometheus.ValueType
+		results [][]Metric
+		want    []float64
+	}{
+		{
+			name:    "gauge-unchanged",
+			valType: prometheus.GaugeValue,
+			results: values(5, 3, 7),
+			want:    []float64{5, 3, 7},
+		},
+		{
+			name:    "total-with-reset",
+			policy:  CounterTotal,
+			valType: prometheus.CounterValue,
+			results: values(5, 8, 2, 4),
+			want:    []float64{5, 8, 10, 12},
+		},
+		{
+			name:    "delta",
+			policy:  CounterDelta,
+			valType: prometheus.CounterValue,
+			results: values(5, 3, -1, 2),
+			want:    []float64{5, 8, 8, 10},
+		},
+		{
+			name:    "max",
+			policy:  CounterMax,
+			valType: prometheus.CounterValue,
+			results: values(5, 8, 2, 9),
+			want:    []float64{5, 8, 8, 9},
+		},
+		{
+			name:    "negative-first-value",
+			policy:  CounterTotal,
+			valType: prometheus.CounterValue,
+			results: values(-5, 1),
+			want:    []float64{0, 6},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &sequenceQueryRunner{results: tt.results}
+			c := NewCollector(r, tt.valType, "fake_metric", "")
+			c.CounterPolicy = tt.policy
+			got := []float64{}
+			for range tt.results {
+				if err := c.Update(context.Background()); err != nil {
+					t.Fatalf("Update() error = %v", err)
+				}
+				got = append(got, c.metrics[0].Values[""])
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Update() values = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCollector_accumulateSeries(t *testing.T) {
+	r := &sequenceQueryRunner{
+		results: [][]Metric{
+			{
+				NewMetric([]string{"key"}, []string{"a"}, map[string]float64{"": 1}),
+				NewMetric([]string{"key"}, []string{"b"}, map[string]float64{"": 10}),
+			},
+			{
+				NewMetric([]string{"key"}, []string{"b"}, map[string]float64{"": math.NaN()}),
+				NewMetric([]string{"key"}, []string{"c"}, map[string]float64{"": math.NaN()}),
+			},
+			{
+				NewMetric([]string{"key"}, []string{"a"}, map[string]float64{"": 3}),
+				NewMetric([]string{"key"}, []string{"b"}, map[string]float64{"": 5}),
+			},
+		},
+	}
+	c := NewCollector(r, prometheus.CounterValue, "fake_metric", "")
+	c.CounterPolicy = CounterDelta
+	c.Update(context.Background())
+	c.Update(context.Background())
+	// A NaN value keeps the counter value, and a new series with a NaN value
+	// is not reported.
+	want := []Metric{
+		NewMetric([]string{"key"}, []string{"b"}, map[string]float64{"": 10}),
+	}
+	if !reflect.DeepEqual(c.metrics, want) {
+		t.Errorf("Update() metrics = %v, want %v", c.metrics, want)
+	}
+	c.Update(context.Background())
+	want = []Metric{
+		NewMetric([]string{"key"}, []string{"a"}, map[string]float64{"": 4}),
+		NewMetric([]string{"key"}, []string{"b"}, map[string]float64{"": 15}),
+	}
+	if !reflect.DeepEqual(c.metrics, want) {
+		t.Errorf("Update() metrics = %v, want %v", c.metrics, want)
+	}
+	// The query results must not be modified.
+	if r.results[0][0].Values[""] != 1 {
+		t.Errorf("Update() modified query results: %v", r.results[0])
+	}
+}
+
+func TestCollector_accumulatePrune(t *testing.T) {
+	c := NewCollector(nil, prometheus.CounterValue, "fake_metric", "")
+	c.CounterPolicy = CounterDelta
+	a := []Metric{NewMetric([]string{"key"}, []string{"a"}, map[string]float64{"": 1})}
+	c.accumulate(a)
+	// Rotating label values must not keep state for every series.
+	for i := 0; i < maxMissedUpdates; i++ {
+		b := []Metric{NewMetric([]string{"key"}, []string{fmt.Sprint(i)}, map[string]float64{"": 1})}
+		c.accumulate(b)
+	}
+	if len(c.counters) != maxMissedUpdates+1 {
+		t.Fatalf("accumulate() kept %d counters, want %d", len(c.counters), maxMissedUpdates+1)
+	}
+	// Series "a" is still within the limit, so it continues from its total.
+	if got := c.accumulate(a); got[0].Values[""] != 2 {
+		t.Errorf("accumulate() = %v, want 2", got[0].Values[""])
+	}
+	for i := 0; i <= maxMissedUpdates; i++ {
+		c.accumulate(nil)
+	}
+	if len(c.counters) != 0 {
+		t.Errorf("accumulate() kept %d counters, want 0", len(c.counters))
+	}
+	// A pruned series starts again as a new counter.
+	if got := c.accumulate(a); got[0].Values[""] != 1 {
+		t.Errorf("accumulate() = %v, want 1", got[0].Values[""])
+	}
+}
@@ -0,0 +1,96 @@
+package sql
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"strings"
+
+	"github.com/m-lab/prometheus-bigquery-exporter/internal/metrics"
+)
+
+// DuplicatePolicy defines how metrics with the same label values in a single
+// query result are resolved.
+type DuplicatePolicy int
+
+const (
+	// DuplicateError rejects results with duplicate label values. The update
+	// fails, and the previous results continue to be reported.
+	DuplicateError DuplicatePolicy = iota
+	// DuplicateFirst keeps the first metric with the same label values.
+	DuplicateFirst
+	// DuplicateLast keeps the last metric with the same label values.
+	DuplicateLast
+	// DuplicateSum adds the values of metrics with the same label values.
+	// Histogram and Summary metrics keep the first metric.
+	DuplicateSum
+	// DuplicateMax keeps the maximum of every value of metrics with the same
+	// label values. Histogram and Summary metrics keep the first metric.
+	DuplicateMax
+)
+
+// labelKey returns a unique key for the label values.
+func labelKey(labelValues []string) string {
+	return strings.Join(labelValues, "\xff")
+}
+
+// combine returns the metric reported for two metrics a and b, in that order,
+// with the same label values.
+func combine(a, b Metric, policy DuplicatePolicy) Metric {
+	if policy == DuplicateLast {
+		return b
+	}
+	if (policy != DuplicateSum && policy != DuplicateMax) || a.Values == nil {
+		return a
+	}
+	values := make(map[string]float64, len(a.Values))
+	for k, v := range a.Values {
+		values[k] = v
+	}
+	for k, v := range b.Values {
+		prev, ok := values[k]
+		switch {
+		case !ok:
+			values[k] = v
+		case policy == DuplicateSum:
+			values[k] = prev + v
+		default:
+			values[k] = math.Max(prev, v)
+		}
+	}
+	return NewMetric(a.LabelKeys, a.LabelValues, values)
+}
+
+// dedupe detects metrics with the same label values in the query results, and
+// resolves them according to the collector DuplicatePolicy. Duplicates are
+// logged and counted. The order of the first metric with every label value is
+// preserved.
+func (col *Collector) dedupe(results []Metric) ([]Metric, error) {
+	index := make(map[string]int, len(results))
+	deduped := make([]Metric, 0, len(results))
+	var duplicates int
+	var example []string
+	for _, m := range results {
+		key := labelKey(m.LabelValues)
+		i, ok := index[key]
+		if !ok {
+			index[key] = len(deduped)
+			deduped = append(deduped, m)
+			continue
+		}
+		if duplicates == 0 {
+			example = m.LabelValues
+		}
+		duplicates++
+		deduped[i] = combine(deduped[i], m, col.DuplicatePolicy)
+	}
+	if duplicates == 0 {
+		return results, nil
+	}
+	metrics.DuplicateSeries.WithLabelValues(col.metricName).Add(float64(duplicates))
+	log.Printf("%s: %d results with duplicate label values, e.g. %q", col.metricName, duplicates, example)
+	if col.DuplicatePolicy == DuplicateError {
+		return nil, fmt.Errorf("%s: %d results with duplicate label values, e.g. %q", col.metricName, duplicates, example)
+	}
+	return deduped, nil
+}
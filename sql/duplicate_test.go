@@ -0,0 +1,119 @@
+package sql
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/m-lab/prometheus-bigquery-exporter/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestCollector_dedupe(t *testing.T) {
+	results := []Metric{
+		NewMetric([]string{"key"}, []string{"a"}, map[string]float64{"": 1, "_x": 5}),
+		NewMetric([]string{"key"}, []string{"b"}, map[string]float64{"": 2, "_x": 6}),
+		NewMetric([]string{"key"}, []string{"a"}, map[string]float64{"": 3, "_x": 4}),
+	}
+	tests := []struct {
+		name    string
+		policy  DuplicatePolicy
+		results []Metric
+		want    []Metric
+		wantErr bool
+	}{
+		{
+			name:    "unique",
+			policy:  DuplicateError,
+			results: results[:2],
+			want:    results[:2],
+		},
+		{
+			name:    "error",
+			policy:  DuplicateError,
+			results: results,
+			wantErr: true,
+		},
+		{
+			name:    "first",
+			policy:  DuplicateFirst,
+			results: results,
+			want:    results[:2],
+		},
+		{
+			name:    "last",
+			policy:  DuplicateLast,
+			results: results,
+			want:    []Metric{results[2], results[1]},
+		},
+		{
+			name:    "sum",
+			policy:  DuplicateSum,
+			results: results,
+			want: []Metric{
+				NewMetric([]string{"key"}, []string{"a"}, map[string]float64{"": 4, "_x": 9}),
+				results[1],
+			},
+		},
+		{
+			name:    "max",
+			policy:  DuplicateMax,
+			results: results,
+			want: []Metric{
+				NewMetric([]string{"key"}, []string{"a"}, map[string]float64{"": 3, "_x": 5}),
+				results[1],
+			},
+		},
+		{
+			name:   "sum-histograms-keep-first",
+			policy: DuplicateSum,
+			results: []Metric{
+				{Histogram: &Histogram{Count: 1}},
+				{Histogram: &Histogram{Count: 2}},
+			},
+			want: []Metric{{Histogram: &Histogram{Count: 1}}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			col := NewCollector(nil, prometheus.GaugeValue, "dedupe_"+tt.name, "")
+			col.DuplicatePolicy = tt.policy
+			got, err := col.dedupe(tt.results)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Collector.dedupe() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Collector.dedupe() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+	if results[0].Values[""] != 1 {
+		t.Errorf("Collector.dedupe() modified results: %#v", results[0])
+	}
+}
+
+func TestCollector_UpdateDuplicates(t *testing.T) {
+	dup := []Metric{
+		NewMetric([]string{"key"}, []string{"a"}, map[string]float64{"": 1}),
+		NewMetric([]string{"key"}, []string{"a"}, map[string]float64{"": 2}),
+	}
+	r := &sequenceQueryRunner{results: [][]Metric{values(5)[0], dup}}
+	col := NewCollector(r, prometheus.GaugeValue, "update_duplicates", "")
+	if err := col.Update(context.Background()); err != nil {
+		t.Fatalf("Update() error = %v", err)
+	}
+	if err := col.Update(context.Background()); err == nil {
+		t.Errorf("Update() expected error for duplicate label values")
+	}
+	if !reflect.DeepEqual(col.metrics, values(5)[0]) {
+		t.Errorf("Update() replaced metrics after error: %#v", col.metrics)
+	}
+	if v := testutil.ToFloat64(metrics.DuplicateSeries.WithLabelValues("update_duplicates")); v != 1 {
+		t.Errorf("bqx_query_duplicate_series_total = %v, want 1", v)
+	}
+	if v := testutil.ToFloat64(metrics.QueryErrors.WithLabelValues("update_duplicates")); v != 1 {
+		t.Errorf("bqx_query_errors_total = %v, want 1", v)
+	}
+}
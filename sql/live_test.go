@@ -67,7 +67,7 @@ func TestLiveQuery(t *testing.T) {
 	}
 	for _, test := range tests {
 		t.Logf("Live query test: %s", test.name)
-		metrics, err := qr.Query(test.query)
+		metrics, err := qr.Query(ctx, test.query)
 		if err != nil {
 			t.Fatal(err)
 		}